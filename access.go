@@ -0,0 +1,33 @@
+package main
+
+import (
+	"log"
+	"os"
+)
+
+// accessLogger writes the -access-log lines; nil when the flag is
+// unset.
+var accessLogger *log.Logger
+
+// openAccessLog opens the -access-log file for appending and arms the
+// logger.
+func openAccessLog(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	accessLogger = log.New(f, "", log.LstdFlags)
+	return nil
+}
+
+// logAccess records that the client attached as uname performed op on
+// path. An anonymous attach logs as "-", common log format style.
+func logAccess(uname, op, path string) {
+	if accessLogger == nil {
+		return
+	}
+	if uname == "" {
+		uname = "-"
+	}
+	accessLogger.Printf("%s %s %s", uname, op, path)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"go.rbn.im/neinp/stat"
+)
+
+// serveBrowse exposes f's tree read-only over plain http at addr:
+// directories render as simple html listings, files are served with
+// range support, so feeds can be checked from a browser or curl
+// without mounting anything.
+func serveBrowse(f *RSSFs, addr string) {
+	log.Fatal(http.ListenAndServe(addr, browseHandler{f: f}))
+}
+
+type browseHandler struct {
+	f *RSSFs
+}
+
+func (h browseHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	e, err := lookupPath(h.f.rootDir(), r.URL.Path)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	st := e.Stat()
+	// Write-only files (ctl) have no business on a read-only
+	// frontend.
+	if st.Mode&0444 == 0 {
+		http.Error(w, "permission denied", http.StatusForbidden)
+		return
+	}
+
+	d, ok := e.(*dir)
+	if !ok {
+		// ServeContent picks the content type from the extension or
+		// by sniffing, and handles range requests, which media
+		// players ask for.
+		http.ServeContent(w, r, st.Name, st.Mtime, entryReader(e))
+		return
+	}
+
+	// Listings need the trailing slash so relative links resolve
+	// below the directory, not beside it.
+	if !strings.HasSuffix(r.URL.Path, "/") {
+		http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	title := html.EscapeString(r.URL.Path)
+	fmt.Fprintf(w, "<!DOCTYPE html>\n<title>%s</title>\n<h1>%s</h1>\n<ul>\n", title, title)
+	if d.parent != nil {
+		fmt.Fprintf(w, "<li><a href=\"../\">..</a></li>\n")
+	}
+	for _, c := range d.children {
+		cst := c.Stat()
+		if cst.Mode&0444 == 0 {
+			continue
+		}
+		name := cst.Name
+		slash := ""
+		if cst.Mode&stat.Dir != 0 {
+			slash = "/"
+		}
+		fmt.Fprintf(w, "<li><a href=\"%s%s\">%s%s</a></li>\n",
+			url.PathEscape(name), slash, html.EscapeString(name), slash)
+	}
+	fmt.Fprintf(w, "</ul>\n")
+}
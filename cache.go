@@ -0,0 +1,264 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cacheTTL is how long cached media is trusted before the origin is
+// asked again whether it changed.
+const cacheTTL = 6 * time.Hour
+
+// cacheMeta describes a cached media file, stored as json next to
+// the content so the origin can be revalidated with a conditional
+// get.
+type cacheMeta struct {
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	Fetched      time.Time `json:"fetched"`
+}
+
+// readCacheMeta reads the metadata stored for the cached content at
+// path.
+func readCacheMeta(path string) (cacheMeta, error) {
+	var m cacheMeta
+	b, err := ioutil.ReadFile(path + ".json")
+	if err != nil {
+		return m, err
+	}
+	return m, json.Unmarshal(b, &m)
+}
+
+// writeCacheMeta stores the metadata for the cached content at path.
+func writeCacheMeta(path string, m cacheMeta) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path+".json", b, 0600)
+}
+
+var redirectsMu sync.Mutex
+
+// readRedirects returns the remembered permanent feed redirects,
+// mapping configured urls to where they moved.
+func readRedirects() map[string]string {
+	m := make(map[string]string)
+	dir, err := cacheDir()
+	if err != nil {
+		return m
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "redirects"))
+	if err != nil {
+		return m
+	}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return make(map[string]string)
+	}
+	return m
+}
+
+// saveRedirect remembers that the feed at old permanently moved to
+// new, surviving restarts.
+func saveRedirect(old, new string) {
+	redirectsMu.Lock()
+	defer redirectsMu.Unlock()
+	dir, err := cacheDir()
+	if err != nil {
+		return
+	}
+	m := readRedirects()
+	m[old] = new
+	b, err := json.Marshal(m)
+	if err != nil {
+		return
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "redirects"), b, 0600); err != nil {
+		log.Print(err)
+	}
+}
+
+var hiddenMu sync.Mutex
+
+// readHidden returns the remembered hidden item ids.
+func readHidden() map[string]bool {
+	m := make(map[string]bool)
+	dir, err := cacheDir()
+	if err != nil {
+		return m
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "hidden"))
+	if err != nil {
+		return m
+	}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return make(map[string]bool)
+	}
+	return m
+}
+
+// saveHidden remembers that the item with id was removed, surviving
+// restarts.
+func saveHidden(id string) {
+	hiddenMu.Lock()
+	defer hiddenMu.Unlock()
+	dir, err := cacheDir()
+	if err != nil {
+		return
+	}
+	m := readHidden()
+	m[id] = true
+	b, err := json.Marshal(m)
+	if err != nil {
+		return
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "hidden"), b, 0600); err != nil {
+		log.Print(err)
+	}
+}
+
+var aliasesMu sync.Mutex
+
+// readAliases returns the remembered feed directory aliases, mapping
+// feed urls to the names the user gave them.
+func readAliases() map[string]string {
+	m := make(map[string]string)
+	dir, err := cacheDir()
+	if err != nil {
+		return m
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "aliases"))
+	if err != nil {
+		return m
+	}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return make(map[string]string)
+	}
+	return m
+}
+
+// saveAlias remembers that the feed at url was renamed to name,
+// surviving restarts.
+func saveAlias(url, name string) {
+	aliasesMu.Lock()
+	defer aliasesMu.Unlock()
+	dir, err := cacheDir()
+	if err != nil {
+		return
+	}
+	m := readAliases()
+	m[url] = name
+	b, err := json.Marshal(m)
+	if err != nil {
+		return
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "aliases"), b, 0600); err != nil {
+		log.Print(err)
+	}
+}
+
+// manifestEntry records one cached download in the manifest.
+type manifestEntry struct {
+	URL     string    `json:"url"`
+	Size    int64     `json:"size"`
+	Fetched time.Time `json:"fetched"`
+}
+
+var manifestMu sync.Mutex
+
+// readManifest returns the cache manifest in dir, mapping cache file
+// names to what they hold; empty if there is none yet.
+func readManifest(dir string) map[string]manifestEntry {
+	m := make(map[string]manifestEntry)
+	b, err := ioutil.ReadFile(filepath.Join(dir, "manifest"))
+	if err != nil {
+		return m
+	}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return make(map[string]manifestEntry)
+	}
+	return m
+}
+
+// writeManifest stores the manifest in dir.
+func writeManifest(dir string, m map[string]manifestEntry) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "manifest"), b, 0600)
+}
+
+// recordCached notes in the manifest that name now holds size bytes
+// downloaded from url, evicting old entries if the cache has
+// outgrown -media-cache-size.
+func recordCached(dir, name, url string, size int64) {
+	manifestMu.Lock()
+	defer manifestMu.Unlock()
+	m := readManifest(dir)
+	m[name] = manifestEntry{URL: url, Size: size, Fetched: time.Now()}
+	enforceQuota(dir, m)
+	if err := writeManifest(dir, m); err != nil {
+		log.Print(err)
+	}
+}
+
+// enforceQuota removes the oldest cached media until the total size
+// fits the configured quota. The just-added entry can fall victim
+// too if it alone is over the limit.
+func enforceQuota(dir string, m map[string]manifestEntry) {
+	if *mediaCacheSize <= 0 {
+		return
+	}
+	quota := *mediaCacheSize << 20
+
+	var total int64
+	for _, e := range m {
+		total += e.Size
+	}
+	for total > quota {
+		oldest := ""
+		for name, e := range m {
+			if oldest == "" || e.Fetched.Before(m[oldest].Fetched) {
+				oldest = name
+			}
+		}
+		if oldest == "" {
+			return
+		}
+		total -= m[oldest].Size
+		delete(m, oldest)
+		os.Remove(filepath.Join(dir, oldest))
+		os.Remove(filepath.Join(dir, oldest+".json"))
+	}
+}
+
+// cacheDir returns the directory media is cached in, creating it if
+// needed. It is -media-cache-dir, or rssfs under the user cache
+// dir.
+func cacheDir() (string, error) {
+	d := *mediaCacheDir
+	if d == "" {
+		ud, err := os.UserCacheDir()
+		if err != nil {
+			return "", err
+		}
+		d = filepath.Join(ud, "rssfs")
+	}
+	return d, os.MkdirAll(d, 0700)
+}
+
+// cacheName returns the file name content derived from url by
+// filter is cached under.
+func cacheName(url string, filter []string) string {
+	h := sha256.Sum256([]byte(url + "\x00" + strings.Join(filter, " ")))
+	return hex.EncodeToString(h[:16])
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// loadCookies reads a netscape cookies.txt file (as exported by
+// browsers and curl) into a jar the http clients can use, for feeds
+// gated by session cookies.
+func loadCookies(path string) (http.CookieJar, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	s := bufio.NewScanner(f)
+	n := 0
+	for s.Scan() {
+		n++
+		line := s.Text()
+		// curl marks httponly cookies with a prefix on the
+		// domain field; it's still a valid entry.
+		line = strings.TrimPrefix(line, "#HttpOnly_")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) != 7 {
+			return nil, fmt.Errorf("%s:%d: malformed cookie line", path, n)
+		}
+
+		expiry, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: bad expiry: %v", path, n, err)
+		}
+		c := &http.Cookie{
+			Domain: fields[0],
+			Path:   fields[2],
+			Secure: fields[3] == "TRUE",
+			Name:   fields[5],
+			Value:  fields[6],
+		}
+		if expiry > 0 {
+			c.Expires = time.Unix(expiry, 0)
+		}
+
+		scheme := "http"
+		if c.Secure {
+			scheme = "https"
+		}
+		u := &url.URL{
+			Scheme: scheme,
+			Host:   strings.TrimPrefix(c.Domain, "."),
+			Path:   c.Path,
+		}
+		jar.SetCookies(u, []*http.Cookie{c})
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return jar, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"go.rbn.im/neinp/message"
+)
+
+// debugSession wraps a session and traces requests when -debug is
+// set. Every connection gets an id and every tag's lifecycle is
+// logged: one line when the T-message arrives, one when the reply
+// goes out, with latency and outcome. That keeps interleaved records
+// from simultaneous clients attributable. Replies pass through
+// unchanged.
+type debugSession struct {
+	*session
+	id uint64
+}
+
+// debugConns numbers connections as they arrive.
+var debugConns uint64
+
+// recv logs the arrival of a T-message and returns the func logging
+// its reply.
+func (d *debugSession) recv(tag uint16, format string, args ...interface{}) func(error) {
+	log.Printf("9p: conn=%d tag=%d <- %s", d.id, tag, fmt.Sprintf(format, args...))
+	start := time.Now()
+	return func(err error) {
+		outcome := "ok"
+		if err != nil {
+			outcome = err.Error()
+		}
+		log.Printf("9p: conn=%d tag=%d -> %s %s",
+			d.id, tag, time.Since(start).Round(time.Microsecond), outcome)
+	}
+}
+
+func (d *debugSession) Version(ctx context.Context, m message.TVersion) (message.RVersion, error) {
+	done := d.recv(m.Tag, "Tversion msize=%d version=%q", m.Msize, m.Version)
+	r, err := d.session.Version(ctx, m)
+	done(err)
+	return r, err
+}
+
+func (d *debugSession) Auth(ctx context.Context, m message.TAuth) (message.RAuth, error) {
+	done := d.recv(m.Tag, "Tauth afid=%d uname=%q", m.Afid, m.Uname)
+	r, err := d.session.Auth(ctx, m)
+	done(err)
+	return r, err
+}
+
+func (d *debugSession) Attach(ctx context.Context, m message.TAttach) (message.RAttach, error) {
+	done := d.recv(m.Tag, "Tattach fid=%d uname=%q aname=%q", m.Fid, m.Uname, m.Aname)
+	r, err := d.session.Attach(ctx, m)
+	done(err)
+	return r, err
+}
+
+func (d *debugSession) Walk(ctx context.Context, m message.TWalk) (message.RWalk, error) {
+	done := d.recv(m.Tag, "Twalk fid=%d newfid=%d wname=%v path=%q",
+		m.Fid, m.Newfid, m.Wname, d.path(m.Fid))
+	r, err := d.session.Walk(ctx, m)
+	done(err)
+	return r, err
+}
+
+func (d *debugSession) Open(ctx context.Context, m message.TOpen) (message.ROpen, error) {
+	done := d.recv(m.Tag, "Topen fid=%d mode=%d path=%q", m.Fid, m.Mode, d.path(m.Fid))
+	r, err := d.session.Open(ctx, m)
+	done(err)
+	return r, err
+}
+
+func (d *debugSession) Read(ctx context.Context, m message.TRead) (message.RRead, error) {
+	done := d.recv(m.Tag, "Tread fid=%d offset=%d count=%d path=%q",
+		m.Fid, m.Offset, m.Count, d.path(m.Fid))
+	r, err := d.session.Read(ctx, m)
+	done(err)
+	return r, err
+}
+
+func (d *debugSession) Write(ctx context.Context, m message.TWrite) (message.RWrite, error) {
+	done := d.recv(m.Tag, "Twrite fid=%d offset=%d count=%d path=%q",
+		m.Fid, m.Offset, len(m.Data), d.path(m.Fid))
+	r, err := d.session.Write(ctx, m)
+	done(err)
+	return r, err
+}
+
+func (d *debugSession) Stat(ctx context.Context, m message.TStat) (message.RStat, error) {
+	done := d.recv(m.Tag, "Tstat fid=%d path=%q", m.Fid, d.path(m.Fid))
+	r, err := d.session.Stat(ctx, m)
+	done(err)
+	return r, err
+}
+
+func (d *debugSession) Wstat(ctx context.Context, m message.TWstat) (message.RWstat, error) {
+	done := d.recv(m.Tag, "Twstat fid=%d name=%q path=%q", m.Fid, m.Stat.Name, d.path(m.Fid))
+	r, err := d.session.Wstat(ctx, m)
+	done(err)
+	return r, err
+}
+
+func (d *debugSession) Clunk(ctx context.Context, m message.TClunk) (message.RClunk, error) {
+	done := d.recv(m.Tag, "Tclunk fid=%d path=%q", m.Fid, d.path(m.Fid))
+	r, err := d.session.Clunk(ctx, m)
+	done(err)
+	return r, err
+}
+
+func (d *debugSession) Remove(ctx context.Context, m message.TRemove) (message.RRemove, error) {
+	done := d.recv(m.Tag, "Tremove fid=%d path=%q", m.Fid, d.path(m.Fid))
+	r, err := d.session.Remove(ctx, m)
+	done(err)
+	return r, err
+}
+
+func (d *debugSession) Flush(ctx context.Context, m message.TFlush) (message.RFlush, error) {
+	done := d.recv(m.Tag, "Tflush oldtag=%d", m.Oldtag)
+	r, err := d.session.Flush(ctx, m)
+	done(err)
+	return r, err
+}
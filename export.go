@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.rbn.im/neinp/fs"
+)
+
+// exportTree materializes f's tree below outDir as real files, for
+// offline archives, rsync replication and static-site pipelines.
+// Media is only downloaded and written when withMedia is set; without
+// it an export stays cheap however many enclosures the feeds carry.
+func exportTree(f *RSSFs, outDir string, withMedia bool) error {
+	return exportDir(f.rootDir(), outDir, withMedia)
+}
+
+func exportDir(d *dir, dst string, withMedia bool) error {
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+	for _, c := range d.children {
+		st := c.Stat()
+		name := filepath.Join(dst, st.Name)
+		if cd, ok := c.(*dir); ok {
+			if err := exportDir(cd, name, withMedia); err != nil {
+				return err
+			}
+			continue
+		}
+		// Skip what has no place in an archive: write-only files
+		// (ctl), the ephemeral stats file, and without -media the
+		// enclosures and their checksums, since reading either
+		// triggers the download.
+		if st.Mode&0444 == 0 {
+			continue
+		}
+		if _, ok := c.(*statsFile); ok {
+			continue
+		}
+		if !withMedia {
+			if _, ok := c.(*mediaFile); ok {
+				continue
+			}
+			if _, ok := c.(*shaFile); ok {
+				continue
+			}
+		}
+		if err := exportFile(c, name, st.Mtime); err != nil {
+			// One broken enclosure shouldn't kill the archive.
+			log.Printf("%s: %v", name, err)
+			os.Remove(name)
+		}
+	}
+	return nil
+}
+
+func exportFile(e fs.Entry, dst string, mtime time.Time) error {
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, entryReader(e))
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(dst, mtime, mtime)
+}
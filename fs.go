@@ -0,0 +1,947 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.rbn.im/neinp"
+	"go.rbn.im/neinp/fid"
+	"go.rbn.im/neinp/fs"
+	"go.rbn.im/neinp/message"
+	"go.rbn.im/neinp/qid"
+	"go.rbn.im/neinp/stat"
+)
+
+// The circuit breaker: after breakerTrips consecutive failed fetches
+// a feed is left alone for breakerCooldown instead of being retried
+// every refresh, which only compounds a publisher's problems.
+const (
+	breakerTrips    = 3
+	breakerCooldown = 2 * time.Hour
+)
+
+// feedState tracks a feed's health across refreshes. Rebuilds are
+// the only thing touching it, serialized by RSSFs.smu.
+type feedState struct {
+	failures  int
+	openUntil time.Time
+	last      []fs.Entry // last successfully built feed dirs
+}
+
+// ioHdrSize is the worst-case 9p message header, the overhead
+// subtracted from msize when sizing read payloads and iounit.
+const ioHdrSize = 24
+
+// Posix errnos (linux values) carried alongside the message, for a
+// future dialect that puts numbers on the wire (9P2000.L).
+const (
+	ENOENT  = 2
+	EBADF   = 9
+	EACCES  = 13
+	ENOTDIR = 20
+	EBUSY   = 16
+	EINVAL  = 22
+	EROFS   = 30
+)
+
+// fsError pairs an errno with its message. Plain 9P2000 only carries
+// the string, but linux v9fs recognizes the canonical texts and maps
+// them back to the right errno, so a missing file reads as ENOENT
+// instead of a blanket EIO.
+type fsError struct {
+	errno int
+	msg   string
+}
+
+func (e *fsError) Error() string { return e.msg }
+
+var (
+	errUnknownFid = &fsError{EBADF, "fid unknown or out of range"}
+	errNotFound   = &fsError{ENOENT, "file does not exist"}
+	errPerm       = &fsError{EACCES, "permission denied"}
+	errNotDir     = &fsError{ENOTDIR, "not a directory"}
+	errReadOnly   = &fsError{EROFS, "read-only file system"}
+	errInUse      = &fsError{EBUSY, "exclusive use file already open"}
+	errMsize      = &fsError{EINVAL, "msize too small"}
+	errBadOffset  = &fsError{EINVAL, "bad offset in directory read"}
+	errSmallCount = &fsError{EINVAL, "read count too small for directory entry"}
+)
+
+// RSSFs is the feed tree shared by all connections. It keeps the
+// tree immutable between refreshes; Refresh swaps in a newly built
+// root, so fids pointing into the old tree stay valid until clunked.
+type RSSFs struct {
+	feeds    []feedConfig
+	uid, gid string
+
+	mu   sync.RWMutex
+	root *dir
+
+	// per-feed fetch health, keyed by feed url. smu guards the map
+	// and serializes rebuilds: Refresh is called from the timer, from
+	// websub pushes and from client requests (ctl, Tremove, Twstat),
+	// and two rebuilds racing would corrupt it.
+	smu   sync.Mutex
+	state map[string]*feedState
+
+	// items removed by the user, by item identity; skipped when
+	// rebuilding the tree.
+	hmu    sync.Mutex
+	hidden map[string]bool
+
+	// directory names the user gave feeds via wstat, by feed url.
+	amu     sync.Mutex
+	aliases map[string]string
+
+	// websub subscriber when -websub-addr is set; nil otherwise.
+	push *websub
+}
+
+// session is the per-connection protocol handler over the shared
+// tree. Each client gets its own fid namespace, so two mounts using
+// the same fid numbers can't corrupt each other's state.
+type session struct {
+	neinp.NopP2000
+
+	f    *RSSFs
+	fids *fid.Map
+
+	// msize negotiated in Version; R-messages must not exceed it.
+	msize uint32
+
+	// uname from Tattach; when set, stats report it as the owner
+	// instead of the global -uid, so multi-user mounts see sensible
+	// ownership.
+	uname string
+
+	// outstanding requests by tag, so Tflush can cancel them, and
+	// the media file each fid has read from, so Tclunk can withdraw
+	// the fid's interest in the download.
+	dmu       sync.Mutex
+	inflight  map[uint16]context.CancelFunc
+	downloads map[uint32]*mediaFile
+	excl      map[uint32]*mediaFile // exclusive claims held by open fids
+
+	// per fid: the directory its attach is clamped to, so ".." can't
+	// climb out of an aname attach, and the resolved path for debug
+	// logging.
+	pmu   sync.Mutex
+	roots map[uint32]*dir
+	paths map[uint32]string
+}
+
+// Session returns a fresh handler for one connection, wrapped in the
+// request logger when -debug is set and the rate limiter when -rate
+// is.
+func (f *RSSFs) Session() neinp.P2000 {
+	s := &session{
+		f:         f,
+		fids:      &fid.Map{},
+		msize:     8192,
+		inflight:  make(map[uint16]context.CancelFunc),
+		downloads: make(map[uint32]*mediaFile),
+		excl:      make(map[uint32]*mediaFile),
+		roots:     make(map[uint32]*dir),
+		paths:     make(map[uint32]string),
+	}
+	p := neinp.P2000(s)
+	if *debug {
+		p = &debugSession{session: s, id: atomic.AddUint64(&debugConns, 1)}
+	}
+	if *rateLimit > 0 {
+		p = &limitSession{P2000: p, tb: newTokenBucket(*rateLimit, *rateBurst)}
+	}
+	return p
+}
+
+// reset drops all per-session state: outstanding requests are
+// cancelled, exclusive claims and downloads released, every fid
+// clunked. Used when the connection goes away and for a mid-session
+// Tversion, which the spec defines as exactly this.
+func (s *session) reset() {
+	s.dmu.Lock()
+	for tag, cancel := range s.inflight {
+		cancel()
+		delete(s.inflight, tag)
+	}
+	for fid, mf := range s.downloads {
+		mf.dropReader()
+		delete(s.downloads, fid)
+	}
+	for fid, mf := range s.excl {
+		mf.release()
+		delete(s.excl, fid)
+	}
+	s.dmu.Unlock()
+	s.fids = &fid.Map{}
+	s.pmu.Lock()
+	s.roots = make(map[uint32]*dir)
+	s.paths = make(map[uint32]string)
+	s.pmu.Unlock()
+}
+
+// close releases what the connection holds when it goes away, so an
+// exclusive open or a running download doesn't outlive its client.
+func (s *session) close() {
+	s.reset()
+}
+
+// path returns the last path resolved for fid, "" if unknown.
+func (s *session) path(fid uint32) string {
+	s.pmu.Lock()
+	defer s.pmu.Unlock()
+	return s.paths[fid]
+}
+
+func (s *session) setPath(fid uint32, p string) {
+	s.pmu.Lock()
+	s.paths[fid] = p
+	s.pmu.Unlock()
+}
+
+func (s *session) delPath(fid uint32) {
+	s.pmu.Lock()
+	delete(s.roots, fid)
+	delete(s.paths, fid)
+	s.pmu.Unlock()
+}
+
+// attachRoot returns the directory fid's attach is clamped to, nil
+// if the fid has none.
+func (s *session) attachRoot(fid uint32) *dir {
+	s.pmu.Lock()
+	defer s.pmu.Unlock()
+	return s.roots[fid]
+}
+
+func (s *session) setAttachRoot(fid uint32, d *dir) {
+	s.pmu.Lock()
+	s.roots[fid] = d
+	s.pmu.Unlock()
+}
+
+// NewRSSFs builds the initial feed tree for feeds and returns a
+// filesystem serving it. Feeds that fail to load are logged and
+// skipped; they get another chance on the next refresh.
+func NewRSSFs(feeds []feedConfig, uid, gid string) *RSSFs {
+	f := &RSSFs{
+		feeds:   feeds,
+		uid:     uid,
+		gid:     gid,
+		state:   make(map[string]*feedState),
+		hidden:  readHidden(),
+		aliases: readAliases(),
+	}
+	for old, new := range readRedirects() {
+		for i := range f.feeds {
+			if f.feeds[i].URL == old {
+				f.feeds[i].URL = new
+			}
+		}
+	}
+	f.root = f.buildRoot()
+	return f
+}
+
+// updateFeedURL adopts the new location of a permanently redirected
+// feed, so later fetches skip the redirect chase.
+func (f *RSSFs) updateFeedURL(old, new string) {
+	log.Printf("%s moved permanently to %s", old, new)
+	f.mu.Lock()
+	for i := range f.feeds {
+		if f.feeds[i].URL == old {
+			f.feeds[i].URL = new
+		}
+	}
+	f.mu.Unlock()
+	saveRedirect(old, new)
+}
+
+// addFeed subscribes to a new feed at runtime and rebuilds the tree,
+// so its directory is there when the write that asked for it
+// returns. With -config set the feed is appended there too, so it
+// survives a restart.
+func (f *RSSFs) addFeed(fc feedConfig) error {
+	fc, err := fc.normalize()
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	for _, old := range f.feeds {
+		if old.URL == fc.URL {
+			f.mu.Unlock()
+			return fmt.Errorf("already subscribed to %s", fc.URL)
+		}
+	}
+	// A feed added through this tree's ctl joins this tree's listen
+	// group, so a restart parses it back into the same group.
+	if len(f.feeds) > 0 {
+		fc.Listen = f.feeds[0].Listen
+	}
+	f.feeds = append(f.feeds, fc)
+	f.mu.Unlock()
+	if *config != "" {
+		if err := appendConfig(*config, fc.URL, fc.Listen); err != nil {
+			log.Print(err)
+		}
+	}
+	f.Refresh()
+	return nil
+}
+
+// removeFeed unsubscribes url and rebuilds the tree. With -config
+// set, the feed's block is dropped from the config file too.
+func (f *RSSFs) removeFeed(url string) error {
+	f.mu.Lock()
+	var kept []feedConfig
+	found := false
+	for _, fc := range f.feeds {
+		if fc.URL == url {
+			found = true
+			continue
+		}
+		kept = append(kept, fc)
+	}
+	f.feeds = kept
+	f.mu.Unlock()
+	if !found {
+		return errNotFound
+	}
+	f.smu.Lock()
+	delete(f.state, url)
+	f.smu.Unlock()
+	if *config != "" {
+		if err := removeConfigFeed(*config, url); err != nil {
+			log.Print(err)
+		}
+	}
+	f.Refresh()
+	return nil
+}
+
+// aliasFeed renames the feed at url to name, remembering the alias
+// across restarts.
+func (f *RSSFs) aliasFeed(url, name string) {
+	f.amu.Lock()
+	f.aliases[url] = name
+	f.amu.Unlock()
+	saveAlias(url, name)
+	f.Refresh()
+}
+
+// tagFeedDirs marks ds as belonging to the subscription at url, so
+// Tremove knows what removing one means, and applies the user's
+// alias when one is set.
+func (f *RSSFs) tagFeedDirs(ds []fs.Entry, url string) {
+	f.amu.Lock()
+	alias := f.aliases[url]
+	f.amu.Unlock()
+	for _, e := range ds {
+		if d, ok := e.(*dir); ok {
+			d.feedURL = url
+			if alias != "" {
+				d.stat.Name = cleanName(alias)
+			}
+		}
+	}
+}
+
+// hideItem records id as removed. The item is skipped from the next
+// rebuild on; the record persists, so it doesn't come back when the
+// feed still carries it.
+func (f *RSSFs) hideItem(id string) {
+	f.hmu.Lock()
+	f.hidden[id] = true
+	f.hmu.Unlock()
+	saveHidden(id)
+}
+
+// isHidden reports whether the item with id was removed by the user.
+func (f *RSSFs) isHidden(id string) bool {
+	if id == "" {
+		return false
+	}
+	f.hmu.Lock()
+	defer f.hmu.Unlock()
+	return f.hidden[id]
+}
+
+// ctl runs one control command written to the ctl file.
+func (f *RSSFs) ctl(line string) error {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil
+	}
+	switch fields[0] {
+	case "add":
+		if len(fields) != 2 {
+			return errors.New("usage: add url")
+		}
+		return f.addFeed(feedConfig{URL: fields[1]})
+	case "refresh":
+		f.Refresh()
+		return nil
+	}
+	return fmt.Errorf("unknown ctl command %q", fields[0])
+}
+
+// rootDir returns the current tree root.
+func (f *RSSFs) rootDir() *dir {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.root
+}
+
+// Refresh refetches all feeds and swaps in the new tree.
+func (f *RSSFs) Refresh() {
+	root := f.buildRoot()
+	f.mu.Lock()
+	f.root = root
+	f.mu.Unlock()
+}
+
+// buildRoot fetches every configured feed and assembles the root
+// directory. Feeds whose breaker is open are not fetched; their last
+// good tree keeps being served until the cooldown passes.
+func (f *RSSFs) buildRoot() *dir {
+	f.smu.Lock()
+	defer f.smu.Unlock()
+
+	f.mu.RLock()
+	fcs := append([]feedConfig(nil), f.feeds...)
+	f.mu.RUnlock()
+
+	var feeds []fs.Entry
+	if !*readOnly {
+		feeds = append(feeds, &ctlFile{f: f})
+	}
+	feeds = append(feeds, &statsFile{f: f})
+	for _, fc := range fcs {
+		st := f.state[fc.URL]
+		if st == nil {
+			st = &feedState{}
+			f.state[fc.URL] = st
+		}
+		if time.Now().Before(st.openUntil) {
+			f.tagFeedDirs(st.last, fc.URL)
+			feeds = append(feeds, st.last...)
+			continue
+		}
+
+		ds, err := f.loadFeed(fc)
+		if err != nil {
+			log.Printf("%s: %v", fc.URL, err)
+			st.failures++
+			var until time.Time
+			if st.failures >= breakerTrips {
+				until = time.Now().Add(breakerCooldown)
+			}
+			// A Retry-After from the host wins if it asks for a
+			// longer pause than the breaker would impose.
+			var ra *retryAfterError
+			if errors.As(err, &ra) {
+				if t := time.Now().Add(ra.after); t.After(until) {
+					until = t
+				}
+			}
+			if until.After(st.openUntil) {
+				st.openUntil = until
+				log.Printf("%s: backing off until %s",
+					fc.URL, until.Format(time.RFC3339))
+			}
+			feeds = append(feeds, st.last...)
+			continue
+		}
+		st.failures = 0
+		st.openUntil = time.Time{}
+		st.last = ds
+		f.tagFeedDirs(ds, fc.URL)
+		feeds = append(feeds, ds...)
+	}
+	return newDir("/", f.uid, f.gid, feeds)
+}
+
+// ctlFile is the writable control file in the root. Commands are one
+// per line, plan 9 style:
+//
+//	echo add https://example.org/feed > /n/rss/ctl
+type ctlFile struct {
+	f *RSSFs
+}
+
+func (c *ctlFile) Stat() stat.Stat {
+	return stat.Stat{
+		Qid:  qid.Qid{Type: qid.TypeFile, Path: qidPath("ctl")},
+		Mode: 0222,
+		Name: "ctl",
+		Uid:  c.f.uid,
+		Gid:  c.f.gid,
+		Muid: c.f.uid,
+	}
+}
+
+func (c *ctlFile) Read(p []byte) (int, error) { return 0, io.EOF }
+
+func (c *ctlFile) Seek(offset int64, whence int) (int64, error) { return 0, nil }
+
+func (c *ctlFile) writeAt(p []byte, off int64) (int, error) {
+	for _, line := range strings.Split(strings.TrimSpace(string(p)), "\n") {
+		if err := c.f.ctl(line); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (s *session) Version(ctx context.Context, m message.TVersion) (message.RVersion, error) {
+	// A Tversion mid-session restarts the conversation: abort what
+	// is in flight and forget every fid, so a renegotiating client
+	// doesn't walk off a stale fid table. On a fresh session this is
+	// a no-op.
+	s.reset()
+
+	// Clients offer the highest dialect they speak; answering with
+	// the base dialect is a legal downgrade. Linux v9fs asking for
+	// 9P2000.u used to be told "unknown" and fail the mount, now it
+	// falls back to plain 9P2000. Serving the .u stat extension
+	// itself (numeric ids, extension field) needs wire-format
+	// support the 9p library doesn't expose.
+	if !strings.HasPrefix(m.Version, "9P2000") {
+		return message.RVersion{Version: "unknown"}, nil
+	}
+	// Negotiate down to -msize; a proposal too small to carry even a
+	// header's worth of payload is refused rather than mis-served.
+	ms := m.Msize
+	if max := uint32(*maxMsize); ms > max {
+		ms = max
+	}
+	if ms < 2*ioHdrSize {
+		return message.RVersion{}, errMsize
+	}
+	s.msize = ms
+	return message.RVersion{Msize: ms, Version: "9P2000"}, nil
+}
+
+// authFile collects the secret a client writes to its auth fid. It
+// lives only in the fid map, never in the tree. The scheme is a plain
+// token compare; a richer exchange (p9any, factotum) would slot in
+// here by giving the file a read side.
+type authFile struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (a *authFile) Stat() stat.Stat {
+	return stat.Stat{Qid: qid.Qid{Type: qid.TypeAuth}, Mode: 0600}
+}
+
+func (a *authFile) Read(p []byte) (int, error) { return 0, errPerm }
+
+func (a *authFile) Seek(offset int64, whence int) (int64, error) { return 0, nil }
+
+func (a *authFile) writeAt(p []byte, off int64) (int, error) {
+	a.mu.Lock()
+	a.buf = append(a.buf, p...)
+	a.mu.Unlock()
+	return len(p), nil
+}
+
+// verified reports whether the secret written so far matches
+// -auth-key. A trailing newline is ignored so echo works.
+func (a *authFile) verified() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	got := bytes.TrimSuffix(a.buf, []byte("\n"))
+	return subtle.ConstantTimeCompare(got, []byte(*authKey)) == 1
+}
+
+func (s *session) Auth(ctx context.Context, m message.TAuth) (message.RAuth, error) {
+	if *authKey == "" {
+		return message.RAuth{}, errors.New("authentication not required")
+	}
+	a := &authFile{}
+	s.fids.Store(m.Afid, a)
+	return message.RAuth{Aqid: a.Stat().Qid}, nil
+}
+
+func (s *session) Write(ctx context.Context, m message.TWrite) (message.RWrite, error) {
+	e, ok := s.fids.Load(m.Fid)
+	if !ok {
+		return message.RWrite{}, errUnknownFid
+	}
+	entry := e
+	if h, ok := e.(*handle); ok {
+		entry = h.Entry
+	}
+	// -ro protects the tree; the auth fid isn't part of it, and
+	// blocking the secret would make -ro -auth-key unusable.
+	if _, isAuth := entry.(*authFile); *readOnly && !isAuth {
+		return message.RWrite{}, errReadOnly
+	}
+	w, ok := entry.(writable)
+	if !ok || entry.Stat().Mode&0222 == 0 {
+		return message.RWrite{}, errPerm
+	}
+	n, err := w.writeAt(m.Data, int64(m.Offset))
+	if err != nil {
+		return message.RWrite{}, err
+	}
+	return message.RWrite{Count: uint32(n)}, nil
+}
+
+func (s *session) Attach(ctx context.Context, m message.TAttach) (message.RAttach, error) {
+	if *authKey != "" {
+		e, ok := s.fids.Load(m.Afid)
+		a, isAuth := e.(*authFile)
+		if !ok || !isAuth || !a.verified() {
+			return message.RAttach{}, errPerm
+		}
+	}
+	s.f.mu.RLock()
+	root := s.f.root
+	s.f.mu.RUnlock()
+
+	// A non-empty aname attaches below the root, so a mount can
+	// expose a single feed (mount -o aname=kernel.org) instead of
+	// the whole tree.
+	e := fs.Entry(root)
+	if m.Aname != "" && m.Aname != "/" {
+		for _, name := range strings.Split(strings.Trim(m.Aname, "/"), "/") {
+			d, ok := e.(*dir)
+			if !ok {
+				return message.RAttach{}, errNotDir
+			}
+			c := d.child(name)
+			if c == nil {
+				return message.RAttach{}, errNotFound
+			}
+			e = c
+		}
+		if _, ok := e.(*dir); !ok {
+			return message.RAttach{}, errNotDir
+		}
+	}
+	s.fids.Store(m.Fid, e)
+	s.uname = m.Uname
+	if d, ok := e.(*dir); ok {
+		s.setAttachRoot(m.Fid, d)
+	}
+	s.setPath(m.Fid, path.Clean("/"+strings.Trim(m.Aname, "/")))
+	return message.RAttach{Qid: e.Stat().Qid}, nil
+}
+
+func (s *session) Walk(ctx context.Context, m message.TWalk) (r message.RWalk, err error) {
+	defer observeOp("walk", time.Now(), &err)
+	e, ok := s.fids.Load(m.Fid)
+	if !ok {
+		return message.RWalk{}, errUnknownFid
+	}
+
+	if len(m.Wname) > 0 {
+		if _, ok := e.(*dir); !ok {
+			return message.RWalk{}, errNotDir
+		}
+	}
+
+	root := s.attachRoot(m.Fid)
+
+	var wqid []qid.Qid
+walk:
+	for _, name := range m.Wname {
+		d, ok := e.(*dir)
+		if !ok {
+			break
+		}
+		switch name {
+		case ".":
+			// stays where it is.
+		case "..":
+			// ".." in the root stays in the root, as the spec wants.
+			// An aname attach clamps the same way at its own root, so
+			// a mount exposing a single feed can't climb out of it.
+			if d != root && d.parent != nil {
+				e = d.parent
+			}
+		default:
+			c := d.child(name)
+			if c == nil {
+				break walk
+			}
+			e = c
+		}
+		wqid = append(wqid, e.Stat().Qid)
+	}
+
+	if len(wqid) < len(m.Wname) {
+		if len(wqid) == 0 {
+			return message.RWalk{}, errNotFound
+		}
+		return message.RWalk{Wqid: wqid}, nil
+	}
+
+	s.fids.Store(m.Newfid, e)
+	if root != nil {
+		s.setAttachRoot(m.Newfid, root)
+	}
+	s.setPath(m.Newfid, path.Clean(path.Join(append([]string{s.path(m.Fid)}, m.Wname...)...)))
+	if len(m.Wname) > 0 {
+		logAccess(s.uname, "walk", s.path(m.Newfid))
+	}
+	return message.RWalk{Wqid: wqid}, nil
+}
+
+func (s *session) Open(ctx context.Context, m message.TOpen) (r message.ROpen, err error) {
+	defer observeOp("open", time.Now(), &err)
+	e, ok := s.fids.Load(m.Fid)
+	if !ok {
+		return message.ROpen{}, errUnknownFid
+	}
+	switch m.Mode & 3 {
+	case message.Oread:
+	case message.Owrite, message.Ordwr:
+		if *readOnly {
+			return message.ROpen{}, errReadOnly
+		}
+		if _, ok := e.(writable); !ok || e.Stat().Mode&0222 == 0 {
+			return message.ROpen{}, errPerm
+		}
+	default:
+		return message.ROpen{}, errPerm
+	}
+	if mf, ok := e.(*mediaFile); ok {
+		if err := mf.acquire(); err != nil {
+			return message.ROpen{}, err
+		}
+		if mf.exclusive {
+			s.dmu.Lock()
+			s.excl[m.Fid] = mf
+			s.dmu.Unlock()
+		}
+	}
+	// Give the fid its own cursor; two opens of the same file must
+	// not interleave seeks on a shared reader.
+	if o, ok := e.(opener); ok {
+		s.fids.Store(m.Fid, &handle{Entry: e, r: o.open()})
+	}
+	return message.ROpen{Qid: e.Stat().Qid, Iounit: s.msize - ioHdrSize}, nil
+}
+
+// begin derives a cancellable context for the request with tag and
+// registers it, so a Tflush naming the tag aborts the operation. The
+// returned func both unregisters and releases the context.
+func (s *session) begin(ctx context.Context, tag uint16) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	s.dmu.Lock()
+	s.inflight[tag] = cancel
+	s.dmu.Unlock()
+	return ctx, func() {
+		s.dmu.Lock()
+		delete(s.inflight, tag)
+		s.dmu.Unlock()
+		cancel()
+	}
+}
+
+// trackDownload marks fid as interested in mf's download, from its
+// first read until it is clunked. Registered once per fid.
+func (s *session) trackDownload(fid uint32, mf *mediaFile) {
+	s.dmu.Lock()
+	if _, ok := s.downloads[fid]; !ok {
+		s.downloads[fid] = mf
+		mf.addReader()
+	}
+	s.dmu.Unlock()
+}
+
+func (s *session) Read(ctx context.Context, m message.TRead) (r message.RRead, err error) {
+	defer observeOp("read", time.Now(), &err)
+	e, ok := s.fids.Load(m.Fid)
+	if !ok {
+		return message.RRead{}, errUnknownFid
+	}
+
+	// Reads are the only requests that can block (waiting for
+	// enclosure bytes), so they are the only ones worth registering
+	// for Tflush; everything else answers from memory.
+	ctx, done := s.begin(ctx, m.Tag)
+	defer done()
+
+	// One access log line per read-through, not per Tread: the first
+	// read of a file starts at offset zero, the 8k-at-a-time reads
+	// that follow don't.
+	if m.Offset == 0 {
+		logAccess(s.uname, "read", s.path(m.Fid))
+	}
+
+	// Never build an R-message larger than the negotiated msize,
+	// whatever count the client asked for.
+	if max := s.msize - ioHdrSize; m.Count > max {
+		m.Count = max
+	}
+
+	entry := e
+	if h, ok := e.(*handle); ok {
+		entry = h.Entry
+		// Directory reads have their own offset rules; the cursor
+		// keeps the bookkeeping per open fid.
+		if dr, ok := h.r.(*dirReader); ok {
+			b, err := dr.readDir(m.Offset, m.Count, s.uname)
+			if err != nil {
+				return message.RRead{}, err
+			}
+			return message.RRead{Data: b}, nil
+		}
+	}
+	if mf, ok := entry.(*mediaFile); ok {
+		// Reading (possibly) starts the download. The fid stays
+		// interested in it from this first read until its clunk; the
+		// transfer is aborted only when the last interested fid goes
+		// away, so a flushed read or a single clunk doesn't kill the
+		// stream for other readers, while an abandoned download
+		// doesn't keep pulling bytes nobody wants.
+		s.trackDownload(m.Fid, mf)
+		buf := make([]byte, m.Count)
+		n, err := mf.readAt(ctx, buf, int64(m.Offset))
+		if err != nil && err != io.EOF {
+			return message.RRead{}, err
+		}
+		return message.RRead{Data: buf[:n]}, nil
+	}
+
+	if _, err := e.Seek(int64(m.Offset), 0); err != nil {
+		return message.RRead{}, err
+	}
+
+	buf := make([]byte, m.Count)
+	var n int
+	if cr, ok := e.(ctxReader); ok {
+		n, err = cr.readCtx(ctx, buf)
+	} else {
+		n, err = e.Read(buf)
+	}
+	if err != nil && err != io.EOF {
+		return message.RRead{}, err
+	}
+	return message.RRead{Data: buf[:n]}, nil
+}
+
+func (s *session) Stat(ctx context.Context, m message.TStat) (r message.RStat, err error) {
+	defer observeOp("stat", time.Now(), &err)
+	e, ok := s.fids.Load(m.Fid)
+	if !ok {
+		return message.RStat{}, errUnknownFid
+	}
+	return message.RStat{Stat: ownedStat(e.Stat(), s.uname)}, nil
+}
+
+// ownedStat reports uname as the owner, leaving the stat alone when
+// the client didn't name one.
+func ownedStat(st stat.Stat, uname string) stat.Stat {
+	if uname != "" {
+		st.Uid = uname
+		st.Muid = uname
+	}
+	return st
+}
+
+func (s *session) Clunk(ctx context.Context, m message.TClunk) (message.RClunk, error) {
+	if _, ok := s.fids.Load(m.Fid); !ok {
+		return message.RClunk{}, errUnknownFid
+	}
+	s.dmu.Lock()
+	if mf, ok := s.downloads[m.Fid]; ok {
+		mf.dropReader()
+		delete(s.downloads, m.Fid)
+	}
+	if mf, ok := s.excl[m.Fid]; ok {
+		mf.release()
+		delete(s.excl, m.Fid)
+	}
+	s.dmu.Unlock()
+	s.fids.Delete(m.Fid)
+	s.delPath(m.Fid)
+	return message.RClunk{}, nil
+}
+
+func (s *session) Remove(ctx context.Context, m message.TRemove) (message.RRemove, error) {
+	if *readOnly {
+		return message.RRemove{}, errReadOnly
+	}
+	e, ok := s.fids.Load(m.Fid)
+	if !ok {
+		return message.RRemove{}, errUnknownFid
+	}
+	// Remove clunks the fid whether or not it succeeds.
+	s.fids.Delete(m.Fid)
+	s.delPath(m.Fid)
+	s.dmu.Lock()
+	if mf, ok := s.downloads[m.Fid]; ok {
+		mf.dropReader()
+		delete(s.downloads, m.Fid)
+	}
+	if mf, ok := s.excl[m.Fid]; ok {
+		mf.release()
+		delete(s.excl, m.Fid)
+	}
+	s.dmu.Unlock()
+
+	d, ok := e.(*dir)
+	if !ok {
+		return message.RRemove{}, errPerm
+	}
+	switch {
+	case d.feedURL != "":
+		if err := s.f.removeFeed(d.feedURL); err != nil {
+			return message.RRemove{}, err
+		}
+	case d.itemID != "":
+		s.f.hideItem(d.itemID)
+		// Rebuild so the directory is gone when the Rremove returns,
+		// not at the next timed refresh; conditional requests keep
+		// the refetch cheap.
+		s.f.Refresh()
+	default:
+		return message.RRemove{}, errPerm
+	}
+	return message.RRemove{}, nil
+}
+
+func (s *session) Wstat(ctx context.Context, m message.TWstat) (message.RWstat, error) {
+	if *readOnly {
+		return message.RWstat{}, errReadOnly
+	}
+	e, ok := s.fids.Load(m.Fid)
+	if !ok {
+		return message.RWstat{}, errUnknownFid
+	}
+	// Renaming a feed directory sets a persistent alias; no other
+	// wstat is meaningful on a tree built from feeds.
+	d, ok := e.(*dir)
+	if !ok || d.feedURL == "" {
+		return message.RWstat{}, errPerm
+	}
+	if m.Stat.Name == "" || m.Stat.Name == d.Stat().Name {
+		return message.RWstat{}, nil
+	}
+	s.f.aliasFeed(d.feedURL, m.Stat.Name)
+	return message.RWstat{}, nil
+}
+
+func (s *session) Flush(ctx context.Context, m message.TFlush) (message.RFlush, error) {
+	s.dmu.Lock()
+	if cancel, ok := s.inflight[m.Oldtag]; ok {
+		cancel()
+	}
+	s.dmu.Unlock()
+	return message.RFlush{}, nil
+}
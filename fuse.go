@@ -0,0 +1,147 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"syscall"
+
+	"bazil.org/fuse"
+	fusefs "bazil.org/fuse/fs"
+	"go.rbn.im/neinp/fs"
+	"go.rbn.im/neinp/stat"
+)
+
+// mountFUSE serves the feed tree at mountpoint through the kernel's
+// fuse interface, for systems without v9fs. The mount is read-only;
+// managing subscriptions stays with the 9p side and the config file.
+func mountFUSE(f *RSSFs, mountpoint string) error {
+	c, err := fuse.Mount(mountpoint,
+		fuse.FSName("rssfs"),
+		fuse.Subtype("rssfs"),
+		fuse.ReadOnly(),
+	)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	return fusefs.Serve(c, fuseFS{f: f})
+}
+
+type fuseFS struct {
+	f *RSSFs
+}
+
+func (fsys fuseFS) Root() (fusefs.Node, error) {
+	return fuseNode{f: fsys.f, path: "/"}, nil
+}
+
+// fuseNode names a tree entry by path, not by pointer: the tree is
+// swapped wholesale on refresh, so each operation resolves against
+// the current root, the same way a 9p walk would.
+type fuseNode struct {
+	f    *RSSFs
+	path string
+}
+
+func (n fuseNode) resolve() (fs.Entry, error) {
+	e, err := lookupPath(n.f.rootDir(), n.path)
+	if err != nil {
+		return nil, fuse.ENOENT
+	}
+	return e, nil
+}
+
+func (n fuseNode) Attr(ctx context.Context, a *fuse.Attr) error {
+	e, err := n.resolve()
+	if err != nil {
+		return err
+	}
+	st := e.Stat()
+	a.Inode = st.Qid.Path
+	a.Mode = os.FileMode(st.Mode & 0777)
+	if st.Mode&stat.Dir != 0 {
+		a.Mode |= os.ModeDir
+	}
+	a.Size = st.Length
+	a.Atime = st.Atime
+	a.Mtime = st.Mtime
+	return nil
+}
+
+func (n fuseNode) Lookup(ctx context.Context, name string) (fusefs.Node, error) {
+	e, err := n.resolve()
+	if err != nil {
+		return nil, err
+	}
+	d, ok := e.(*dir)
+	if !ok {
+		return nil, fuse.Errno(syscall.ENOTDIR)
+	}
+	if d.child(name) == nil {
+		return nil, fuse.ENOENT
+	}
+	return fuseNode{f: n.f, path: path.Join(n.path, name)}, nil
+}
+
+func (n fuseNode) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	e, err := n.resolve()
+	if err != nil {
+		return nil, err
+	}
+	d, ok := e.(*dir)
+	if !ok {
+		return nil, fuse.Errno(syscall.ENOTDIR)
+	}
+	var ents []fuse.Dirent
+	for _, c := range d.children {
+		st := c.Stat()
+		typ := fuse.DT_File
+		if st.Mode&stat.Dir != 0 {
+			typ = fuse.DT_Dir
+		}
+		ents = append(ents, fuse.Dirent{Inode: st.Qid.Path, Type: typ, Name: st.Name})
+	}
+	return ents, nil
+}
+
+func (n fuseNode) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fusefs.Handle, error) {
+	e, err := n.resolve()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := e.(*dir); ok {
+		return n, nil
+	}
+	// Like Topen, every open gets its own cursor.
+	return &fuseHandle{r: entryReader(e)}, nil
+}
+
+// fuseHandle is one open file's cursor. Fuse reads carry absolute
+// offsets, so each read seeks first.
+type fuseHandle struct {
+	r io.ReadSeeker
+}
+
+func (h *fuseHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	if _, err := h.r.Seek(req.Offset, io.SeekStart); err != nil {
+		return err
+	}
+	buf := make([]byte, req.Size)
+	var n int
+	var err error
+	if cr, ok := h.r.(ctxReader); ok {
+		n, err = cr.readCtx(ctx, buf)
+	} else {
+		n, err = h.r.Read(buf)
+	}
+	if err != nil && err != io.EOF {
+		return err
+	}
+	resp.Data = buf[:n]
+	return nil
+}
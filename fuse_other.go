@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package main
+
+import "errors"
+
+// mountFUSE needs kernel fuse support, which this platform doesn't
+// have.
+func mountFUSE(f *RSSFs, mountpoint string) error {
+	return errors.New("mount is not supported on this platform")
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// geminiGet fetches a gemini url and returns the response media type
+// and body. Redirects are followed a few times. Gemini certificates
+// are self-signed by convention (trust on first use), so they are
+// not verified against the web pki.
+func geminiGet(u string) (string, []byte, error) {
+	for redirects := 0; redirects < 5; redirects++ {
+		p, err := url.Parse(u)
+		if err != nil {
+			return "", nil, err
+		}
+		host := p.Host
+		if p.Port() == "" {
+			host = net.JoinHostPort(p.Hostname(), "1965")
+		}
+
+		dialer := &net.Dialer{Timeout: *connectTimeout}
+		conn, err := tls.DialWithDialer(dialer, "tcp", host, &tls.Config{
+			InsecureSkipVerify: true,
+			ServerName:         p.Hostname(),
+		})
+		if err != nil {
+			return "", nil, err
+		}
+
+		fmt.Fprintf(conn, "%s\r\n", u)
+		r := bufio.NewReader(conn)
+		header, err := r.ReadString('\n')
+		if err != nil {
+			conn.Close()
+			return "", nil, err
+		}
+		header = strings.TrimRight(header, "\r\n")
+		if len(header) < 2 {
+			conn.Close()
+			return "", nil, fmt.Errorf("%s: malformed response header", u)
+		}
+		status, meta := header[:2], strings.TrimSpace(header[2:])
+
+		switch header[0] {
+		case '2':
+			b, err := ioutil.ReadAll(r)
+			conn.Close()
+			return meta, b, err
+		case '3':
+			conn.Close()
+			nu, err := p.Parse(meta)
+			if err != nil {
+				return "", nil, err
+			}
+			u = nu.String()
+			continue
+		default:
+			conn.Close()
+			return "", nil, fmt.Errorf("%s: gemini status %s: %s", u, status, meta)
+		}
+	}
+	return "", nil, errors.New("too many gemini redirects")
+}
+
+// The bits of atom we synthesize when converting a gmisub page.
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomEntry struct {
+	Title   string   `xml:"title"`
+	ID      string   `xml:"id"`
+	Updated string   `xml:"updated"`
+	Link    atomLink `xml:"link"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+}
+
+// gmisubToAtom converts a gmisub index page (gemtext whose link
+// labels start with an iso date) into an atom document the feed
+// parser understands. The first heading becomes the feed title.
+func gmisubToAtom(page *url.URL, b []byte) ([]byte, error) {
+	feed := atomFeed{Title: page.String()}
+	for _, line := range strings.Split(string(b), "\n") {
+		if strings.HasPrefix(line, "# ") && feed.Title == page.String() {
+			feed.Title = strings.TrimSpace(line[2:])
+			continue
+		}
+		if !strings.HasPrefix(line, "=>") {
+			continue
+		}
+		fields := strings.Fields(line[2:])
+		if len(fields) < 2 {
+			continue
+		}
+		link, label := fields[0], fields[1:]
+		if _, err := time.Parse("2006-01-02", label[0]); err != nil {
+			continue
+		}
+		if lu, err := page.Parse(link); err == nil {
+			link = lu.String()
+		}
+		title := strings.TrimPrefix(strings.Join(label[1:], " "), "- ")
+		if title == "" {
+			title = link
+		}
+		feed.Entries = append(feed.Entries, atomEntry{
+			Title:   title,
+			ID:      link,
+			Updated: label[0] + "T00:00:00Z",
+			Link:    atomLink{Href: link},
+		})
+	}
+	if len(feed.Entries) == 0 {
+		return nil, errNoFeed
+	}
+	return xml.Marshal(feed)
+}
+
+// geminiFeed fetches a gemini feed source: atom (or rss) served over
+// gemini is passed through, gmisub index pages are converted.
+func geminiFeed(u *url.URL) ([]byte, error) {
+	meta, b, err := geminiGet(u.String())
+	if err != nil {
+		return nil, err
+	}
+	if strings.Contains(meta, "text/gemini") {
+		return gmisubToAtom(u, b)
+	}
+	return b, nil
+}
@@ -0,0 +1,12 @@
+module go.rbn.im/rssfs
+
+go 1.14
+
+require (
+	bazil.org/fuse v0.0.0-20200117225306-7b5117fecadc
+	github.com/go-git/go-billy/v5 v5.0.0
+	github.com/mmcdole/gofeed v1.1.0
+	github.com/willscott/go-nfs v0.0.1
+	go.rbn.im/neinp v1.0.1
+	golang.org/x/net v0.0.0-20200202094626-16171245cfb2
+)
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// httpClient is the client for all outbound requests: discovery,
+// feed fetches and media downloads. Unlike http.DefaultClient it
+// has timeouts, so one hung server doesn't block startup or a read
+// forever, and it pools connections per host instead of opening a
+// fresh one for every fetch. There is deliberately no overall
+// request timeout: media downloads are allowed to take as long as
+// they take, a server that stops sending headers is caught by
+// ResponseHeaderTimeout. Built in main once flags are parsed.
+var httpClient *http.Client
+
+// torClient routes everything through the socks5 proxy given with
+// -tor, for feeds that opt in via the per-feed tor option. nil when
+// -tor is unset.
+var torClient *http.Client
+
+// torDial dials through the -tor proxy; nil when unset. The shared
+// client uses it automatically for .onion hosts.
+var torDial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// rootCAs holds the pool built from -ca-file; nil means the system
+// roots.
+var rootCAs *x509.CertPool
+
+// newTLSConfig returns the tls settings shared by all transports.
+func newTLSConfig() *tls.Config {
+	return &tls.Config{RootCAs: rootCAs}
+}
+
+// defaultDial and defaultProxy are the dial chain and proxy func the
+// shared client ended up with, kept so per-feed clients (mtls) can
+// be built the same way.
+var (
+	defaultDial  dialFunc
+	defaultProxy func(*http.Request) (*url.URL, error)
+)
+
+// feedNetClient returns a client like the shared (or tor) one, but
+// with feed-specific network settings: a client certificate for
+// mutual tls, disabled verification for self-signed feed servers,
+// and host address overrides in the spirit of curl --resolve. The
+// overrides rewrite the dialed address only, so tls verification
+// still runs against the original host name.
+func feedNetClient(fc feedConfig) *http.Client {
+	dial := defaultDial
+	var proxyFunc func(*http.Request) (*url.URL, error)
+	if fc.Tor && torDial != nil {
+		dial = torDial
+	} else {
+		proxyFunc = defaultProxy
+	}
+
+	if len(fc.Resolve) > 0 {
+		base := dial
+		overrides := fc.Resolve
+		dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if host, port, err := net.SplitHostPort(addr); err == nil {
+				if ip, ok := overrides[host]; ok {
+					addr = net.JoinHostPort(ip, port)
+				}
+			}
+			return base(ctx, network, addr)
+		}
+	}
+
+	t := newTransport(dial)
+	t.Proxy = proxyFunc
+	cfg := newTLSConfig()
+	if fc.cert != nil {
+		cfg.Certificates = []tls.Certificate{*fc.cert}
+	}
+	cfg.InsecureSkipVerify = fc.Insecure
+	t.TLSClientConfig = cfg
+	return &http.Client{Transport: wrapTransport(t), Jar: httpClient.Jar}
+}
+
+// familyDialer wraps a dialer, forcing the address family given with
+// -4 or -6 on tcp connections, for hosts with broken routes in one
+// family.
+type familyDialer struct {
+	network string
+	d       *net.Dialer
+}
+
+func (f familyDialer) Dial(network, addr string) (net.Conn, error) {
+	return f.DialContext(context.Background(), network, addr)
+}
+
+func (f familyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if network == "tcp" {
+		network = f.network
+	}
+	return f.d.DialContext(ctx, network, addr)
+}
+
+// contextDial adapts a proxy.Dialer to a DialContext function.
+func contextDial(d proxy.Dialer) dialFunc {
+	if cd, ok := d.(proxy.ContextDialer); ok {
+		return cd.DialContext
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return d.Dial(network, addr)
+	}
+}
+
+// uaTransport sets the configured User-Agent, and Accept-Language if
+// -accept-language is given, on requests that don't already carry
+// them; several feed hosts block go's default agent, and some
+// multi-language sites vary feed content by Accept-Language.
+type uaTransport struct {
+	rt http.RoundTripper
+}
+
+func (t uaTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("User-Agent") == "" || (*acceptLang != "" && req.Header.Get("Accept-Language") == "") {
+		req = req.Clone(req.Context())
+		if req.Header.Get("User-Agent") == "" {
+			req.Header.Set("User-Agent", *userAgent)
+		}
+		if *acceptLang != "" && req.Header.Get("Accept-Language") == "" {
+			req.Header.Set("Accept-Language", *acceptLang)
+		}
+	}
+	return t.rt.RoundTrip(req)
+}
+
+// headerTransport adds a fixed set of headers (per-feed config) to
+// every request.
+type headerTransport struct {
+	h  http.Header
+	rt http.RoundTripper
+}
+
+func (t headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for k, vs := range t.h {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+	return t.rt.RoundTrip(req)
+}
+
+// compressionTransport asks for gzip/deflate and transparently
+// decodes the response body. go's automatic gzip handling turns
+// itself off as soon as the Accept-Encoding header is set by hand,
+// and never does deflate, so handle both here for every transport.
+type compressionTransport struct {
+	rt http.RoundTripper
+}
+
+func (t compressionTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("Accept-Encoding") == "" && req.Header.Get("Range") == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("Accept-Encoding", "gzip, deflate")
+	}
+	resp, err := t.rt.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+	switch strings.ToLower(resp.Header.Get("Content-Encoding")) {
+	case "gzip":
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		resp.Body = decodedBody{gz, resp.Body}
+	case "deflate":
+		resp.Body = decodedBody{flate.NewReader(resp.Body), resp.Body}
+	default:
+		return resp, nil
+	}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	return resp, nil
+}
+
+// decodedBody reads the decompressed stream but closes the
+// underlying connection body.
+type decodedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// hostLimiter spaces requests to the same host at least an interval
+// apart, so aggressive refresh intervals or mass media opens don't
+// hammer a single publisher. A nil limiter admits everything.
+type hostLimiter struct {
+	interval time.Duration
+
+	mu   sync.Mutex
+	next map[string]time.Time
+}
+
+// hostLim is the global limiter, set up in newHTTPClient when
+// -per-host-interval is given.
+var hostLim *hostLimiter
+
+// wait blocks until the caller may talk to host, or ctx is done.
+func (l *hostLimiter) wait(ctx context.Context, host string) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	now := time.Now()
+	at := l.next[host]
+	if at.Before(now) {
+		at = now
+	}
+	l.next[host] = at.Add(l.interval)
+	l.mu.Unlock()
+
+	d := at.Sub(now)
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// limitTransport holds requests until the per-host limiter lets
+// them through.
+type limitTransport struct {
+	rt http.RoundTripper
+}
+
+func (t limitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := hostLim.wait(req.Context(), req.URL.Hostname()); err != nil {
+		return nil, err
+	}
+	return t.rt.RoundTrip(req)
+}
+
+// fetchSem caps outbound requests in flight across feed refreshes
+// and media downloads together, set up in newHTTPClient from
+// -max-concurrent-fetches. nil means no limit.
+var fetchSem chan struct{}
+
+// semTransport holds requests until a fetchSem slot is free. The
+// slot is held until the response body is closed, since the socket
+// stays busy that long.
+type semTransport struct {
+	rt http.RoundTripper
+}
+
+func (t semTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if fetchSem == nil {
+		return t.rt.RoundTrip(req)
+	}
+	select {
+	case fetchSem <- struct{}{}:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	resp, err := t.rt.RoundTrip(req)
+	if err != nil {
+		<-fetchSem
+		return nil, err
+	}
+	resp.Body = &releaseBody{body: resp.Body}
+	return resp, nil
+}
+
+// releaseBody frees the fetchSem slot when the response body is
+// closed, at most once.
+type releaseBody struct {
+	body io.ReadCloser
+	once sync.Once
+}
+
+func (b *releaseBody) Read(p []byte) (int, error) {
+	return b.body.Read(p)
+}
+
+func (b *releaseBody) Close() error {
+	err := b.body.Close()
+	b.once.Do(func() { <-fetchSem })
+	return err
+}
+
+// wrapTransport layers the common request/response handling (user
+// agent, compression, rate and concurrency limiting) over a
+// transport. The concurrency slot is taken innermost, after the
+// per-host wait, so queueing for a slow host doesn't hold a slot.
+func wrapTransport(t http.RoundTripper) http.RoundTripper {
+	return uaTransport{compressionTransport{limitTransport{semTransport{t}}}}
+}
+
+// redirectTracker remembers the final target of permanent (301/308)
+// redirects a client followed, so callers can adopt the new
+// location.
+type redirectTracker struct {
+	final string
+}
+
+// trackingClient returns a copy of c that records permanent
+// redirects in the returned tracker.
+func trackingClient(c *http.Client) (*http.Client, *redirectTracker) {
+	tr := &redirectTracker{}
+	c2 := *c
+	c2.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		if res := req.Response; res != nil &&
+			(res.StatusCode == http.StatusMovedPermanently || res.StatusCode == http.StatusPermanentRedirect) {
+			tr.final = req.URL.String()
+		}
+		return nil
+	}
+	return &c2, tr
+}
+
+// newTransport returns the common transport settings around dial.
+// ForceAttemptHTTP2 is needed because setting DialContext or
+// TLSClientConfig by hand turns go's automatic http/2 off; podcast
+// cdns handle many small requests per episode much better over a
+// single h2 connection.
+func newTransport(dial dialFunc) *http.Transport {
+	return &http.Transport{
+		DialContext:           dial,
+		TLSClientConfig:       newTLSConfig(),
+		TLSHandshakeTimeout:   *tlsTimeout,
+		ResponseHeaderTimeout: *httpTimeout,
+		ExpectContinueTimeout: time.Second,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   *maxIdlePerHost,
+		IdleConnTimeout:       90 * time.Second,
+	}
+}
+
+func newHTTPClient() *http.Client {
+	if *hostInterval > 0 {
+		hostLim = &hostLimiter{interval: *hostInterval, next: make(map[string]time.Time)}
+	}
+	if *maxFetches > 0 {
+		fetchSem = make(chan struct{}, *maxFetches)
+	}
+	if *caFile != "" {
+		pem, err := ioutil.ReadFile(*caFile)
+		if err != nil {
+			log.Fatalf("ca-file: %v", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			log.Fatalf("ca-file: no certificates found in %s", *caFile)
+		}
+		rootCAs = pool
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   *connectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	if *resolverAddr != "" {
+		dialer.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				d := net.Dialer{Timeout: 5 * time.Second}
+				return d.DialContext(ctx, network, *resolverAddr)
+			},
+		}
+	}
+	network := "tcp"
+	switch {
+	case *force4 && *force6:
+		log.Fatal("-4 and -6 are mutually exclusive")
+	case *force4:
+		network = "tcp4"
+	case *force6:
+		network = "tcp6"
+	}
+	fd := familyDialer{network, dialer}
+	dial := dialFunc(fd.DialContext)
+	proxyFunc := http.ProxyFromEnvironment
+
+	if *proxyAddr != "" {
+		u, err := url.Parse(*proxyAddr)
+		if err != nil {
+			log.Fatalf("proxy: %v", err)
+		}
+		switch u.Scheme {
+		case "socks5":
+			d, err := proxy.FromURL(u, fd)
+			if err != nil {
+				log.Fatalf("proxy: %v", err)
+			}
+			dial = contextDial(d)
+			proxyFunc = nil
+		case "http", "https":
+			proxyFunc = http.ProxyURL(u)
+		default:
+			log.Fatalf("proxy: unsupported scheme %q", u.Scheme)
+		}
+	}
+
+	if *torAddr != "" {
+		u, err := url.Parse(*torAddr)
+		if err != nil {
+			log.Fatalf("tor: %v", err)
+		}
+		d, err := proxy.FromURL(u, fd)
+		if err != nil {
+			log.Fatalf("tor: %v", err)
+		}
+		torDial = contextDial(d)
+		torClient = &http.Client{Transport: wrapTransport(newTransport(torDial))}
+	}
+
+	// .onion hosts only resolve inside tor; send them through the
+	// tor dialer no matter what feed they belong to.
+	onionDial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if host, _, err := net.SplitHostPort(addr); err == nil && strings.HasSuffix(host, ".onion") {
+			if torDial == nil {
+				return nil, errors.New("onion address, but -tor is not set")
+			}
+			return torDial(ctx, network, addr)
+		}
+		return dial(ctx, network, addr)
+	}
+
+	defaultDial = onionDial
+	defaultProxy = proxyFunc
+
+	t := newTransport(onionDial)
+	t.Proxy = proxyFunc
+	return &http.Client{Transport: wrapTransport(t)}
+}
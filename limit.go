@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.rbn.im/neinp"
+	"go.rbn.im/neinp/message"
+)
+
+// tokenBucket is a classic token bucket: tokens accrue at rate per
+// second up to burst, and each request spends one. wait blocks until
+// a token is available, throttling the client rather than erroring;
+// 9p clients don't handle transient refusals gracefully.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// wait takes a token, sleeping until one accrues if the bucket is
+// empty. It returns early when ctx is cancelled.
+func (b *tokenBucket) wait(ctx context.Context) error {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens--
+	var sleep time.Duration
+	if b.tokens < 0 {
+		sleep = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+	if sleep <= 0 {
+		return nil
+	}
+	t := time.NewTimer(sleep)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// limitSession throttles a connection's T-messages through a token
+// bucket when -rate is set, so one misbehaving client can't
+// monopolize the server or trigger unbounded outbound fetches.
+type limitSession struct {
+	neinp.P2000
+	tb *tokenBucket
+}
+
+func (l *limitSession) Version(ctx context.Context, m message.TVersion) (message.RVersion, error) {
+	if err := l.tb.wait(ctx); err != nil {
+		return message.RVersion{}, err
+	}
+	return l.P2000.Version(ctx, m)
+}
+
+func (l *limitSession) Auth(ctx context.Context, m message.TAuth) (message.RAuth, error) {
+	if err := l.tb.wait(ctx); err != nil {
+		return message.RAuth{}, err
+	}
+	return l.P2000.Auth(ctx, m)
+}
+
+func (l *limitSession) Attach(ctx context.Context, m message.TAttach) (message.RAttach, error) {
+	if err := l.tb.wait(ctx); err != nil {
+		return message.RAttach{}, err
+	}
+	return l.P2000.Attach(ctx, m)
+}
+
+func (l *limitSession) Walk(ctx context.Context, m message.TWalk) (message.RWalk, error) {
+	if err := l.tb.wait(ctx); err != nil {
+		return message.RWalk{}, err
+	}
+	return l.P2000.Walk(ctx, m)
+}
+
+func (l *limitSession) Open(ctx context.Context, m message.TOpen) (message.ROpen, error) {
+	if err := l.tb.wait(ctx); err != nil {
+		return message.ROpen{}, err
+	}
+	return l.P2000.Open(ctx, m)
+}
+
+func (l *limitSession) Read(ctx context.Context, m message.TRead) (message.RRead, error) {
+	if err := l.tb.wait(ctx); err != nil {
+		return message.RRead{}, err
+	}
+	return l.P2000.Read(ctx, m)
+}
+
+func (l *limitSession) Write(ctx context.Context, m message.TWrite) (message.RWrite, error) {
+	if err := l.tb.wait(ctx); err != nil {
+		return message.RWrite{}, err
+	}
+	return l.P2000.Write(ctx, m)
+}
+
+func (l *limitSession) Stat(ctx context.Context, m message.TStat) (message.RStat, error) {
+	if err := l.tb.wait(ctx); err != nil {
+		return message.RStat{}, err
+	}
+	return l.P2000.Stat(ctx, m)
+}
+
+func (l *limitSession) Wstat(ctx context.Context, m message.TWstat) (message.RWstat, error) {
+	if err := l.tb.wait(ctx); err != nil {
+		return message.RWstat{}, err
+	}
+	return l.P2000.Wstat(ctx, m)
+}
+
+func (l *limitSession) Clunk(ctx context.Context, m message.TClunk) (message.RClunk, error) {
+	if err := l.tb.wait(ctx); err != nil {
+		return message.RClunk{}, err
+	}
+	return l.P2000.Clunk(ctx, m)
+}
+
+func (l *limitSession) Remove(ctx context.Context, m message.TRemove) (message.RRemove, error) {
+	if err := l.tb.wait(ctx); err != nil {
+		return message.RRemove{}, err
+	}
+	return l.P2000.Remove(ctx, m)
+}
+
+// Flush is deliberately not throttled: it cancels work already in
+// flight, and making a client wait to cancel would hold resources
+// longer, the opposite of what the limiter is for.
+
+// close forwards connection teardown to the wrapped session.
+func (l *limitSession) close() {
+	if c, ok := l.P2000.(interface{ close() }); ok {
+		c.close()
+	}
+}
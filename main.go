@@ -0,0 +1,442 @@
+// rssfs serves the contents of rss feeds as a 9p filesystem.
+//
+// Feeds are given as urls on the command line or listed in a config
+// file, one url per line. Each feed becomes a directory containing a
+// directory per item, which in turn holds small files for the item
+// fields and, if the item carries an enclosure, the media file itself.
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.rbn.im/neinp"
+)
+
+// version identifies this build in the default user agent.
+const version = "1.0"
+
+var (
+	addr    = flag.String("addr", ":9999", "address to listen on: host:port, or a dial string like tcp!*!9999 or unix!/path/to/sock")
+	tlsCert = flag.String("tls-cert", "", "serve 9p over tls with this certificate (requires -tls-key)")
+	tlsKey  = flag.String("tls-key", "", "private key for -tls-cert")
+	tlsCA   = flag.String("tls-client-ca", "", "pem bundle of cas; when set, clients must present a certificate signed by one of them")
+	authKey = flag.String("auth-key", "", "shared secret clients must write to their auth fid before attaching (empty disables auth)")
+
+	maxConns    = flag.Int("max-conns", 0, "maximum simultaneous 9p connections (0 disables the limit)")
+	maxMsize    = flag.Int("msize", 128*1024, "maximum 9p message size negotiated with clients")
+	idleTimeout = flag.Duration("idle-timeout", 0, "close 9p sessions with no traffic for this long (0 disables)")
+	rateLimit   = flag.Float64("rate", 0, "limit each connection to this many 9p requests per second (0 disables)")
+	rateBurst   = flag.Int("rate-burst", 32, "requests a connection may burst above -rate")
+	stdio       = flag.Bool("stdio", false, "serve 9p on stdin/stdout instead of listening, for 9pserve and ssh-forwarded mounts")
+	srvName     = flag.String("srv", "", "post the service to /srv/<name> instead of listening (plan 9 only)")
+	uid         = flag.String("uid", "rssfs", "user name files are owned by")
+	gid         = flag.String("gid", "rssfs", "group name files are owned by")
+	config      = flag.String("config", "", "file listing feed urls, one per line")
+	refresh     = flag.Duration("refresh", 30*time.Minute, "interval between feed refreshes")
+	lenient     = flag.Bool("lenient", false, "clean up malformed xml (bad entities, control characters) before parsing feeds")
+	debug       = flag.Bool("debug", false, "log one line per 9p request: type, fid, path, latency, outcome")
+	readOnly    = flag.Bool("ro", false, "serve read-only: reject writes, removes and renames (for shared mounts)")
+	accessFile  = flag.String("access-log", "", "append a line per walk and per first read of a file to this file")
+	webdavAddr  = flag.String("webdav-addr", "", "also serve the tree read-only over webdav on this address")
+	httpAddr    = flag.String("http-addr", "", "also serve the tree as browsable html on this address")
+	nfsAddr     = flag.String("nfs-addr", "", "also serve the tree read-only over nfsv3 on this address (experimental; media sizes are only known after download, so nfs clients may copy enclosures as empty files)")
+
+	mediaWorkers = flag.Int("media-workers", 4, "maximum number of concurrent enclosure downloads")
+	videoCmd     = flag.String("video-cmd", "", "command fetching video links to stdout, %s replaced by the url (e.g. 'yt-dlp -o - %s')")
+
+	stableNames    = flag.Bool("stable-media-names", false, "derive media file names from item guid and date instead of the enclosure url")
+	mediaCacheDir  = flag.String("media-cache-dir", "", "directory for cached media (default: rssfs under the user cache dir)")
+	mediaCacheSize = flag.Int64("media-cache-size", 0, "maximum media cache size in megabytes (0 disables the limit)")
+
+	connectTimeout = flag.Duration("connect-timeout", 30*time.Second, "timeout for establishing outbound connections")
+	tlsTimeout     = flag.Duration("tls-handshake-timeout", 10*time.Second, "timeout for the tls handshake on outbound connections")
+	httpTimeout    = flag.Duration("http-timeout", 30*time.Second, "how long to wait for a response to start; the body may take longer")
+	proxyAddr      = flag.String("proxy", "", "proxy for all outbound requests, http:// or socks5:// (default: honor HTTP(S)_PROXY/NO_PROXY)")
+	torAddr        = flag.String("tor", "", "socks5 proxy used for .onion hosts and feeds with the tor option (e.g. socks5://127.0.0.1:9050)")
+	userAgent      = flag.String("user-agent", "rssfs/"+version+" (+https://git.rbn.im/rssfs)", "user agent sent with every outbound request")
+	acceptLang     = flag.String("accept-language", "", "Accept-Language header sent with every outbound request")
+	cookieFile     = flag.String("cookies", "", "netscape cookies.txt file whose cookies are sent with matching requests")
+	caFile         = flag.String("ca-file", "", "pem bundle of additional ca certificates to trust")
+	hostInterval   = flag.Duration("per-host-interval", 0, "minimum delay between requests to the same host (0 disables)")
+	maxIdlePerHost = flag.Int("max-idle-per-host", 4, "idle connections kept per host for reuse across requests")
+	maxFetches     = flag.Int("max-concurrent-fetches", 0, "maximum outbound requests in flight at once, across feeds and media (0 disables)")
+	bridgeURL      = flag.String("rss-bridge", "", "base url of an rss-bridge instance, used by feeds with the bridge option")
+	websubAddr     = flag.String("websub-addr", "", "listen address for websub push callbacks (enables subscribing to feeds that declare a hub)")
+	websubBase     = flag.String("websub-url", "", "public base url hubs reach the callback listener under (default http://<websub-addr>)")
+	nitterURL      = flag.String("nitter", "", "base url of a nitter instance, used to follow twitter/x profile urls")
+	wayback        = flag.Bool("wayback", false, "serve the latest internet archive snapshot of feeds that return 404/410")
+	resolverAddr   = flag.String("resolver", "", "dns server for outbound lookups (host:port), instead of the system resolver")
+	force4         = flag.Bool("4", false, "use ipv4 only for outbound connections")
+	force6         = flag.Bool("6", false, "use ipv6 only for outbound connections")
+)
+
+// listenTLSConfig builds the server tls settings for the 9p
+// listener. With -tls-client-ca set, only clients presenting a
+// certificate signed by one of the given cas get a connection, which
+// authenticates mounts without a 9p auth protocol.
+func listenTLSConfig() (*tls.Config, error) {
+	if *tlsCert == "" || *tlsKey == "" {
+		return nil, errors.New("-tls-cert and -tls-key must be given together")
+	}
+	cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+	if err != nil {
+		return nil, err
+	}
+	tc := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if *tlsCA != "" {
+		pem, err := ioutil.ReadFile(*tlsCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("tls-client-ca: no certificates found in %s", *tlsCA)
+		}
+		tc.ClientCAs = pool
+		tc.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tc, nil
+}
+
+// idleConn enforces -idle-timeout by arming a read deadline before
+// every read, so a session with no traffic for the duration errors
+// out and gets closed instead of pinning resources forever.
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c idleConn) Read(p []byte) (int, error) {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(p)
+}
+
+// listen opens the service listener. Besides a plain host:port,
+// plan 9 style dial strings are accepted: tcp!host!port (with * for
+// any host) and unix!/path/to/sock. A stale socket file from an
+// earlier run is removed first.
+func listen(addr string) (net.Listener, error) {
+	parts := strings.Split(addr, "!")
+	switch {
+	case len(parts) == 1:
+		return net.Listen("tcp", addr)
+	case parts[0] == "unix" && len(parts) == 2:
+		os.Remove(parts[1])
+		return net.Listen("unix", parts[1])
+	case parts[0] == "tcp" && len(parts) == 3:
+		host := parts[1]
+		if host == "*" {
+			host = ""
+		}
+		return net.Listen("tcp", net.JoinHostPort(host, parts[2]))
+	}
+	return nil, fmt.Errorf("bad listen address %q", addr)
+}
+
+func main() {
+	flag.Parse()
+	httpClient = newHTTPClient()
+	if *cookieFile != "" {
+		jar, err := loadCookies(*cookieFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		httpClient.Jar = jar
+		if torClient != nil {
+			torClient.Jar = jar
+		}
+	}
+
+	// An optional subcommand precedes the feed urls: "mount" serves
+	// the tree through fuse instead of listening for 9p, "export"
+	// writes it to disk once and exits.
+	args := flag.Args()
+	mountpoint := ""
+	exportOut := ""
+	exportMedia := false
+	if len(args) > 0 {
+		switch args[0] {
+		case "mount":
+			if len(args) < 2 {
+				log.Fatal("usage: rssfs [flags] mount mountpoint [url ...]")
+			}
+			mountpoint = args[1]
+			args = args[2:]
+		case "export":
+			ec := flag.NewFlagSet("export", flag.ExitOnError)
+			out := ec.String("o", "rssfs-export", "directory the tree is written to")
+			media := ec.Bool("media", false, "also download and export enclosures")
+			ec.Parse(args[1:])
+			exportOut = *out
+			exportMedia = *media
+			args = ec.Args()
+		}
+	}
+
+	var feeds []feedConfig
+	for _, u := range args {
+		feeds = append(feeds, feedConfig{URL: u})
+	}
+	if *config != "" {
+		cf, err := readConfig(*config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		feeds = append(feeds, cf...)
+	}
+	if len(feeds) == 0 {
+		log.Fatal("no feeds given")
+	}
+	for i := range feeds {
+		fc, err := feeds[i].normalize()
+		if err != nil {
+			log.Fatal(err)
+		}
+		feeds[i] = fc
+	}
+	if *mediaWorkers < 1 {
+		log.Fatal("media-workers must be at least 1")
+	}
+	if *accessFile != "" {
+		if err := openAccessLog(*accessFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	mediaSem = make(chan struct{}, *mediaWorkers)
+
+	if *stdio {
+		for _, fc := range feeds {
+			if fc.URL == "-" {
+				log.Fatal("-stdio cannot be combined with a stdin feed")
+			}
+		}
+	}
+
+	// Feeds may be bound to their own listener in the config; each
+	// group gets its own tree. Feeds without a listen address go to
+	// -addr.
+	groups := make(map[string][]feedConfig)
+	var addrs []string
+	for _, fc := range feeds {
+		a := fc.Listen
+		if a == "" {
+			a = *addr
+		}
+		if _, ok := groups[a]; !ok {
+			addrs = append(addrs, a)
+		}
+		groups[a] = append(groups[a], fc)
+	}
+	if len(addrs) > 1 && (*stdio || *srvName != "" || mountpoint != "" || exportOut != "") {
+		log.Fatal("listen groups in the config cannot be combined with -stdio, -srv, mount or export")
+	}
+
+	fss := make(map[string]*RSSFs)
+	for _, a := range addrs {
+		fss[a] = NewRSSFs(groups[a], *uid, *gid)
+	}
+	if *websubAddr != "" {
+		// Push notifications go to the default group; per-listener
+		// groups still refresh on the timer.
+		fs, ok := fss[*addr]
+		if !ok {
+			fs = fss[addrs[0]]
+		}
+		base := *websubBase
+		if base == "" {
+			base = "http://" + *websubAddr
+		}
+		fs.push = newWebsub(fs, base)
+		go fs.push.listen(*websubAddr)
+	}
+	if *webdavAddr != "" {
+		// Like websub, the extra frontend serves the default group.
+		fs, ok := fss[*addr]
+		if !ok {
+			fs = fss[addrs[0]]
+		}
+		go serveWebdav(fs, *webdavAddr)
+	}
+	if *httpAddr != "" {
+		fs, ok := fss[*addr]
+		if !ok {
+			fs = fss[addrs[0]]
+		}
+		go serveBrowse(fs, *httpAddr)
+	}
+	if *nfsAddr != "" {
+		fs, ok := fss[*addr]
+		if !ok {
+			fs = fss[addrs[0]]
+		}
+		go serveNFS(fs, *nfsAddr)
+	}
+	go func() {
+		for range time.Tick(*refresh) {
+			for _, fs := range fss {
+				fs.Refresh()
+			}
+		}
+	}()
+
+	if exportOut != "" {
+		if err := exportTree(fss[addrs[0]], exportOut, exportMedia); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if mountpoint != "" {
+		if err := mountFUSE(fss[addrs[0]], mountpoint); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *stdio {
+		s := neinp.NewServer(fss[addrs[0]].Session())
+		if err := s.Serve(struct {
+			io.Reader
+			io.Writer
+		}{os.Stdin, os.Stdout}); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *srvName != "" {
+		c, err := postSrv(*srvName)
+		if err != nil {
+			log.Fatal(err)
+		}
+		s := neinp.NewServer(fss[addrs[0]].Session())
+		if err := s.Serve(c); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	var tc *tls.Config
+	if *tlsCert != "" || *tlsKey != "" || *tlsCA != "" {
+		var err error
+		tc, err = listenTLSConfig()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	listeners := make(map[string]net.Listener)
+	for _, a := range addrs {
+		l, err := listen(a)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if tc != nil {
+			l = tls.NewListener(l, tc)
+		}
+		listeners[a] = l
+	}
+
+	// On SIGINT/SIGTERM stop accepting, then cut the remaining
+	// sessions and wait for their handlers to wind down. Persistent
+	// state (cache manifest, redirects, hidden items, aliases) is
+	// written as it changes, so there is nothing left to flush here.
+	shutdown := make(chan struct{})
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		log.Print("shutting down")
+		close(shutdown)
+		for _, l := range listeners {
+			l.Close()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for _, a := range addrs {
+		wg.Add(1)
+		go func(l net.Listener, fs *RSSFs) {
+			defer wg.Done()
+			acceptLoop(l, fs, shutdown)
+		}(listeners[a], fss[a])
+	}
+	wg.Wait()
+}
+
+// Live connections across all listeners, for -max-conns and for
+// cutting sessions at shutdown.
+var (
+	connsMu sync.Mutex
+	conns   = make(map[net.Conn]bool)
+)
+
+// acceptLoop serves 9p connections from l, each getting its own
+// session over fs, until shutdown is closed.
+func acceptLoop(l net.Listener, fs *RSSFs, shutdown chan struct{}) {
+	var wg sync.WaitGroup
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			select {
+			case <-shutdown:
+				connsMu.Lock()
+				for c := range conns {
+					c.Close()
+				}
+				connsMu.Unlock()
+				wg.Wait()
+				return
+			default:
+			}
+			log.Print(err)
+			continue
+		}
+		connsMu.Lock()
+		if *maxConns > 0 && len(conns) >= *maxConns {
+			connsMu.Unlock()
+			log.Printf("%s: connection limit reached", c.RemoteAddr())
+			c.Close()
+			continue
+		}
+		conns[c] = true
+		connsMu.Unlock()
+		wg.Add(1)
+		go func(c net.Conn) {
+			defer wg.Done()
+			defer func() {
+				connsMu.Lock()
+				delete(conns, c)
+				connsMu.Unlock()
+				c.Close()
+			}()
+			rw := io.ReadWriter(c)
+			if *idleTimeout > 0 {
+				rw = idleConn{Conn: c, timeout: *idleTimeout}
+			}
+			p := fs.Session()
+			s := neinp.NewServer(p)
+			if err := s.Serve(rw); err != nil {
+				log.Print(err)
+			}
+			if cl, ok := p.(interface{ close() }); ok {
+				cl.close()
+			}
+		}(c)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"go.rbn.im/neinp/qid"
+	"go.rbn.im/neinp/stat"
+)
+
+// latency histogram bucket bounds; the last bucket catches the rest.
+var bucketBounds = []time.Duration{
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+	10 * time.Second,
+}
+
+// opStats aggregates protocol metrics for one operation: counts,
+// errors and a coarse log-scale latency histogram - enough to tell a
+// slow feed (reads stuck in the seconds buckets) from slow protocol
+// handling (walks and stats creeping past a millisecond).
+type opStats struct {
+	count   uint64
+	errors  uint64
+	total   time.Duration
+	buckets [6]uint64
+}
+
+var (
+	metricsMu sync.Mutex
+	metrics   = make(map[string]*opStats)
+)
+
+// recordOp notes one completed operation.
+func recordOp(op string, d time.Duration, err error) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	st := metrics[op]
+	if st == nil {
+		st = &opStats{}
+		metrics[op] = st
+	}
+	st.count++
+	if err != nil {
+		st.errors++
+	}
+	st.total += d
+	i := 0
+	for i < len(bucketBounds) && d >= bucketBounds[i] {
+		i++
+	}
+	st.buckets[i]++
+}
+
+// observeOp is the defer hook handlers use: started at start, ended
+// with *err.
+func observeOp(op string, start time.Time, err *error) {
+	recordOp(op, time.Since(start), *err)
+}
+
+// renderMetrics formats the collected metrics for the stats file.
+func renderMetrics() []byte {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+
+	ops := make([]string, 0, len(metrics))
+	for op := range metrics {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+
+	var buf bytes.Buffer
+	labels := []string{"<1ms", "<10ms", "<100ms", "<1s", "<10s", "slower"}
+	for _, op := range ops {
+		st := metrics[op]
+		avg := time.Duration(0)
+		if st.count > 0 {
+			avg = st.total / time.Duration(st.count)
+		}
+		fmt.Fprintf(&buf, "%s: %d ops, %d errors, avg %s\n",
+			op, st.count, st.errors, avg.Round(time.Microsecond))
+		fmt.Fprintf(&buf, "\t")
+		for i, l := range labels {
+			fmt.Fprintf(&buf, "%s %d  ", l, st.buckets[i])
+		}
+		fmt.Fprintf(&buf, "\n")
+	}
+	return buf.Bytes()
+}
+
+// statsFile is the read-only stats file in the root. Each open
+// renders a fresh snapshot of the protocol metrics.
+type statsFile struct {
+	f *RSSFs
+}
+
+func (s *statsFile) Stat() stat.Stat {
+	return stat.Stat{
+		Qid:  qid.Qid{Type: qid.TypeFile, Path: qidPath("stats")},
+		Mode: 0444,
+		Name: "stats",
+		Uid:  s.f.uid,
+		Gid:  s.f.gid,
+		Muid: s.f.uid,
+	}
+}
+
+func (s *statsFile) Read(p []byte) (int, error) { return 0, io.EOF }
+
+func (s *statsFile) Seek(offset int64, whence int) (int64, error) { return 0, nil }
+
+func (s *statsFile) open() io.ReadSeeker {
+	return bytes.NewReader(renderMetrics())
+}
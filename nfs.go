@@ -0,0 +1,152 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/go-git/go-billy/v5"
+	nfs "github.com/willscott/go-nfs"
+	nfshelper "github.com/willscott/go-nfs/helpers"
+)
+
+// serveNFS exposes f's tree read-only over NFSv3 at addr, for
+// appliances and systems where neither 9p nor fuse is practical.
+// Experimental: no auth beyond the export being read-only, so bind it
+// to a trusted interface.
+func serveNFS(f *RSSFs, addr string) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	handler := nfshelper.NewNullAuthHandler(nfsFS{f: f})
+	log.Fatal(nfs.Serve(l, nfshelper.NewCachingHandler(handler, 1024)))
+}
+
+// nfsFS adapts the tree to the billy filesystem interface go-nfs
+// serves from. Paths resolve against the current root, like a 9p
+// walk; every mutating method answers permission denied.
+type nfsFS struct {
+	f *RSSFs
+}
+
+func (n nfsFS) Open(filename string) (billy.File, error) {
+	e, err := lookupPath(n.f.rootDir(), filename)
+	if err != nil {
+		return nil, os.ErrNotExist
+	}
+	return &nfsFile{name: filename, r: entryReader(e)}, nil
+}
+
+func (n nfsFS) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return nil, os.ErrPermission
+	}
+	return n.Open(filename)
+}
+
+func (n nfsFS) Stat(filename string) (os.FileInfo, error) {
+	e, err := lookupPath(n.f.rootDir(), filename)
+	if err != nil {
+		return nil, os.ErrNotExist
+	}
+	return entryInfo{st: e.Stat()}, nil
+}
+
+func (n nfsFS) Lstat(filename string) (os.FileInfo, error) {
+	return n.Stat(filename)
+}
+
+func (n nfsFS) ReadDir(p string) ([]os.FileInfo, error) {
+	e, err := lookupPath(n.f.rootDir(), p)
+	if err != nil {
+		return nil, os.ErrNotExist
+	}
+	d, ok := e.(*dir)
+	if !ok {
+		return nil, os.ErrInvalid
+	}
+	var infos []os.FileInfo
+	for _, c := range d.children {
+		infos = append(infos, entryInfo{st: c.Stat()})
+	}
+	return infos, nil
+}
+
+func (n nfsFS) Join(elem ...string) string { return path.Join(elem...) }
+
+func (n nfsFS) Readlink(link string) (string, error) { return "", os.ErrInvalid }
+
+func (n nfsFS) Create(filename string) (billy.File, error) { return nil, os.ErrPermission }
+
+func (n nfsFS) Rename(oldpath, newpath string) error { return os.ErrPermission }
+
+func (n nfsFS) Remove(filename string) error { return os.ErrPermission }
+
+func (n nfsFS) TempFile(dir, prefix string) (billy.File, error) { return nil, os.ErrPermission }
+
+func (n nfsFS) MkdirAll(filename string, perm os.FileMode) error { return os.ErrPermission }
+
+func (n nfsFS) Symlink(target, link string) error { return os.ErrPermission }
+
+func (n nfsFS) Chroot(p string) (billy.Filesystem, error) { return nil, os.ErrPermission }
+
+func (n nfsFS) Root() string { return "/" }
+
+// Capabilities advertises what the export can do, so go-nfs doesn't
+// probe for write support.
+func (n nfsFS) Capabilities() billy.Capability {
+	return billy.ReadCapability | billy.SeekCapability
+}
+
+// nfsFile is one open's cursor over a tree entry. NFS reads are
+// stateless and carry absolute offsets, hence ReadAt; the mutex keeps
+// concurrent reads from interleaving seeks on the shared cursor.
+type nfsFile struct {
+	name string
+
+	mu sync.Mutex
+	r  io.ReadSeeker
+}
+
+func (f *nfsFile) Name() string { return f.name }
+
+func (f *nfsFile) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.r.Read(p)
+}
+
+func (f *nfsFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, err := f.r.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(f.r, p)
+	// A read overlapping the end of the file is a short read with
+	// io.EOF, not an error.
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (f *nfsFile) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.r.Seek(offset, whence)
+}
+
+func (f *nfsFile) Close() error { return nil }
+
+func (f *nfsFile) Write(p []byte) (int, error) { return 0, os.ErrPermission }
+
+func (f *nfsFile) Truncate(size int64) error { return os.ErrPermission }
+
+func (f *nfsFile) Lock() error { return nil }
+
+func (f *nfsFile) Unlock() error { return nil }
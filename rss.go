@@ -0,0 +1,1604 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+	ext "github.com/mmcdole/gofeed/extensions"
+	"go.rbn.im/neinp/fs"
+	"go.rbn.im/neinp/qid"
+	"go.rbn.im/neinp/stat"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
+)
+
+var errNoFeed = errors.New("no feed found")
+
+// retryAfterError is a 429 or 503 response carrying a Retry-After
+// header; the refresh loop uses it to stay away for as long as the
+// host asked.
+type retryAfterError struct {
+	msg   string
+	after time.Duration
+}
+
+func (e *retryAfterError) Error() string {
+	return e.msg
+}
+
+// statusError is a non-200 response, keeping the code around so
+// callers can react to specific statuses.
+type statusError struct {
+	code int
+	msg  string
+}
+
+func (e *statusError) Error() string {
+	return e.msg
+}
+
+// checkStatus turns a non-200 response into an error. On 429/503 a
+// Retry-After header becomes part of the error so callers can back
+// off instead of immediately retrying a host that is already
+// struggling.
+func checkStatus(resp *http.Response, u string) error {
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	msg := fmt.Sprintf("%s: %s", u, resp.Status)
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		if d := parseRetryAfter(resp.Header.Get("Retry-After")); d > 0 {
+			return &retryAfterError{msg: msg, after: d}
+		}
+	}
+	return &statusError{code: resp.StatusCode, msg: msg}
+}
+
+// parseRetryAfter parses a Retry-After value, either seconds or an
+// http date; 0 if absent or malformed.
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// get fetches url with c and returns the response body.
+func get(c *http.Client, u string) ([]byte, error) {
+	resp, err := c.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := checkStatus(resp, u); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// feedUrl resolves u to a feed url. If u serves a feed directly it
+// is returned as-is; if it serves html, the page is searched for a
+// feed link.
+func feedUrl(c *http.Client, u string) (string, error) {
+	urls, err := feedUrls(c, u)
+	if err != nil {
+		return "", err
+	}
+	return urls[0], nil
+}
+
+// feedUrls resolves u to feed urls. If u serves a feed directly it
+// is the only result; if it serves html, every feed the page
+// declares is returned. Meta refresh redirects (feedburner,
+// cloudflare-style interstitials) are followed a few times.
+func feedUrls(c *http.Client, u string) ([]string, error) {
+	for redirects := 0; redirects < 5; redirects++ {
+		resp, err := c.Get(u)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkStatus(resp, u); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+
+		ct := resp.Header.Get("Content-Type")
+		switch {
+		case strings.Contains(ct, "rss"),
+			strings.Contains(ct, "atom"),
+			strings.Contains(ct, "xml"),
+			strings.Contains(ct, "json"):
+			resp.Body.Close()
+			return []string{u}, nil
+		case strings.Contains(ct, "html"):
+			b, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				return nil, err
+			}
+			page := resp.Request.URL
+			if urls, err := findFeeds(bytes.NewReader(b), page); err == nil {
+				return urls, nil
+			}
+			if target := findMetaRefresh(bytes.NewReader(b), page); target != "" && target != u {
+				u = target
+				continue
+			}
+			// No declared alternate; fall back to heuristics so
+			// a plain homepage url still works.
+			if fu := findAnchorFeed(bytes.NewReader(b), page); fu != "" {
+				return []string{fu}, nil
+			}
+			if fu := probeFeeds(c, page); fu != "" {
+				return []string{fu}, nil
+			}
+			return nil, errNoFeed
+		default:
+			resp.Body.Close()
+			return nil, errNoFeed
+		}
+	}
+	return nil, errNoFeed
+}
+
+// findMetaRefresh returns the target of an html meta refresh tag,
+// resolved against page; "" if the document has none.
+func findMetaRefresh(r io.Reader, page *url.URL) string {
+	z := html.NewTokenizer(r)
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return ""
+		case html.StartTagToken, html.SelfClosingTagToken:
+			t := z.Token()
+			if t.Data != "meta" {
+				continue
+			}
+			var equiv, content string
+			for _, a := range t.Attr {
+				switch strings.ToLower(a.Key) {
+				case "http-equiv":
+					equiv = a.Val
+				case "content":
+					content = a.Val
+				}
+			}
+			if !strings.EqualFold(equiv, "refresh") {
+				continue
+			}
+			i := strings.Index(strings.ToLower(content), "url=")
+			if i < 0 {
+				continue
+			}
+			target := strings.Trim(strings.TrimSpace(content[i+4:]), `'"`)
+			if target == "" {
+				continue
+			}
+			if page != nil {
+				if u, err := page.Parse(target); err == nil {
+					return u.String()
+				}
+			}
+			return target
+		}
+	}
+}
+
+// findFeeds scans an html page for link tags announcing rss, atom or
+// json feeds and returns their hrefs, in page order. Relative hrefs
+// are resolved against page, honoring a <base> tag if the document
+// carries one.
+func findFeeds(r io.Reader, page *url.URL) ([]string, error) {
+	resolve := func(base *url.URL, href string) string {
+		if base == nil {
+			return href
+		}
+		u, err := base.Parse(href)
+		if err != nil {
+			return href
+		}
+		return u.String()
+	}
+
+	base := page
+	var found []string
+	z := html.NewTokenizer(r)
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			if len(found) == 0 {
+				return nil, errNoFeed
+			}
+			return found, nil
+		case html.StartTagToken, html.SelfClosingTagToken:
+			t := z.Token()
+			var rel, typ, href string
+			for _, a := range t.Attr {
+				switch a.Key {
+				case "rel":
+					rel = a.Val
+				case "type":
+					typ = a.Val
+				case "href":
+					href = a.Val
+				}
+			}
+			if t.Data == "base" && href != "" && page != nil {
+				if bu, err := page.Parse(href); err == nil {
+					base = bu
+				}
+				continue
+			}
+			if t.Data != "link" || rel != "alternate" || href == "" {
+				continue
+			}
+			switch typ {
+			case "application/rss+xml", "application/atom+xml",
+				"application/feed+json", "application/json":
+				found = append(found, resolve(base, href))
+			}
+		}
+	}
+}
+
+// stdinFeed holds the feed read from stdin when "-" is given as a
+// source. Stdin can only be read once, so it is kept around for
+// refreshes.
+var (
+	stdinOnce sync.Once
+	stdinData []byte
+	stdinErr  error
+)
+
+// fetchFeed returns the raw feed data for fc: stdin for "-", the
+// local filesystem for file:// urls, the network otherwise.
+func (f *RSSFs) fetchFeed(fc feedConfig) ([]byte, error) {
+	if fc.URL == "-" {
+		stdinOnce.Do(func() {
+			stdinData, stdinErr = ioutil.ReadAll(os.Stdin)
+		})
+		return stdinData, stdinErr
+	}
+	if u, err := url.Parse(fc.URL); err == nil && u.Scheme == "file" {
+		return ioutil.ReadFile(u.Path)
+	}
+	if u, err := url.Parse(fc.URL); err == nil && u.Scheme == "gemini" {
+		return geminiFeed(u)
+	}
+	// A bare path to a pre-downloaded feed file works too, which
+	// keeps local experiments to one shell line.
+	if u, err := url.Parse(fc.URL); err != nil || u.Scheme == "" {
+		if _, err := os.Stat(fc.URL); err == nil {
+			return ioutil.ReadFile(fc.URL)
+		}
+	}
+	if fc.Bridge != "" {
+		fu, err := bridgeFeed(fc)
+		if err != nil {
+			return nil, err
+		}
+		return get(fc.client(), fu)
+	}
+	if fu := nitterFeed(fc.URL); fu != "" {
+		return get(fc.client(), fu)
+	}
+	if fu := siteFeed(fc.URL); fu != "" {
+		return get(fc.client(), fu)
+	}
+	if fu := youtubeFeed(fc.client(), fc.URL); fu != "" {
+		return get(fc.client(), fu)
+	}
+
+	c, track := trackingClient(fc.client())
+	fu, err := feedUrl(c, fc.URL)
+	if err != nil {
+		return nil, err
+	}
+	if nu := track.final; nu != "" && nu != fc.URL {
+		f.updateFeedURL(fc.URL, nu)
+	}
+	return get(fc.client(), fu)
+}
+
+// bridgeFeed builds the rss-bridge url for a feed with the bridge
+// option: the -rss-bridge instance asked to render fc's bridge as
+// atom. The site url is passed as the url parameter unless the
+// config supplies one itself, since that's what most bridges expect.
+func bridgeFeed(fc feedConfig) (string, error) {
+	if *bridgeURL == "" {
+		return "", errors.New("bridge option requires -rss-bridge")
+	}
+	u, err := url.Parse(*bridgeURL)
+	if err != nil {
+		return "", err
+	}
+	q := url.Values{}
+	q.Set("action", "display")
+	q.Set("bridge", fc.Bridge)
+	q.Set("format", "Atom")
+	q.Set("url", fc.URL)
+	for _, p := range fc.BridgeParams {
+		kv := strings.SplitN(p, "=", 2)
+		q.Set(kv[0], kv[1])
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// nitterFeed translates a twitter/x profile url to the rss feed of
+// the nitter instance given with -nitter, so accounts can be
+// followed by pasting the profile url. Returns "" for anything
+// else, or when no instance is configured.
+func nitterFeed(u string) string {
+	if *nitterURL == "" {
+		return ""
+	}
+	p, err := url.Parse(u)
+	if err != nil {
+		return ""
+	}
+	switch strings.TrimPrefix(p.Host, "www.") {
+	case "twitter.com", "mobile.twitter.com", "x.com":
+	default:
+		return ""
+	}
+	handle := strings.Trim(p.Path, "/")
+	if handle == "" || strings.Contains(handle, "/") {
+		return ""
+	}
+	return strings.TrimSuffix(*nitterURL, "/") + "/" + handle + "/rss"
+}
+
+// siteFeed translates well-known aggregator urls to their native
+// feed urls, so reddit.com/r/foo or lobste.rs work as given. Returns
+// "" for anything else, including urls already pointing at a feed.
+func siteFeed(u string) string {
+	p, err := url.Parse(u)
+	if err != nil {
+		return ""
+	}
+	path := strings.TrimSuffix(p.Path, "/")
+	switch strings.TrimPrefix(p.Host, "www.") {
+	case "reddit.com", "old.reddit.com":
+		if strings.HasSuffix(path, ".rss") {
+			return ""
+		}
+		return "https://www.reddit.com" + path + "/.rss"
+	case "lobste.rs":
+		if path == "" {
+			return "https://lobste.rs/rss"
+		}
+		if strings.HasPrefix(path, "/t/") && !strings.HasSuffix(path, ".rss") {
+			return "https://lobste.rs" + path + ".rss"
+		}
+	case "news.ycombinator.com":
+		if path == "" || path == "/news" {
+			return "https://news.ycombinator.com/rss"
+		}
+	}
+	return ""
+}
+
+// youtubeFeed translates youtube channel, handle and playlist urls
+// to the matching feeds/videos.xml url, so channels can be
+// subscribed to by pasting the normal browser url. Returns "" for
+// anything else.
+func youtubeFeed(c *http.Client, u string) string {
+	p, err := url.Parse(u)
+	if err != nil {
+		return ""
+	}
+	if strings.TrimPrefix(p.Host, "www.") != "youtube.com" {
+		return ""
+	}
+	const base = "https://www.youtube.com/feeds/videos.xml"
+	seg := func(prefix string) string {
+		s := strings.TrimPrefix(p.Path, prefix)
+		if i := strings.IndexByte(s, '/'); i >= 0 {
+			s = s[:i]
+		}
+		return s
+	}
+	switch {
+	case strings.HasPrefix(p.Path, "/channel/"):
+		return base + "?channel_id=" + seg("/channel/")
+	case strings.HasPrefix(p.Path, "/user/"):
+		return base + "?user=" + seg("/user/")
+	case p.Path == "/playlist":
+		if id := p.Query().Get("list"); id != "" {
+			return base + "?playlist_id=" + id
+		}
+	case strings.HasPrefix(p.Path, "/@"):
+		// Handles don't map to a feed parameter; dig the channel
+		// id out of the page.
+		b, err := get(c, u)
+		if err != nil {
+			return ""
+		}
+		if id := youtubeChannelID(b); id != "" {
+			return base + "?channel_id=" + id
+		}
+	}
+	return ""
+}
+
+// youtubeChannelID extracts the channel id from a channel page.
+func youtubeChannelID(b []byte) string {
+	const marker = `"channelId":"`
+	i := bytes.Index(b, []byte(marker))
+	if i < 0 {
+		return ""
+	}
+	rest := b[i+len(marker):]
+	j := bytes.IndexByte(rest, '"')
+	if j < 0 {
+		return ""
+	}
+	return string(rest[:j])
+}
+
+// findAnchorFeed scans a page's anchors for the first href that
+// looks like it points at a feed.
+func findAnchorFeed(r io.Reader, page *url.URL) string {
+	z := html.NewTokenizer(r)
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return ""
+		case html.StartTagToken, html.SelfClosingTagToken:
+			t := z.Token()
+			if t.Data != "a" {
+				continue
+			}
+			for _, a := range t.Attr {
+				if a.Key != "href" || !likelyFeed(a.Val) {
+					continue
+				}
+				if page != nil {
+					if u, err := page.Parse(a.Val); err == nil {
+						return u.String()
+					}
+				}
+				return a.Val
+			}
+		}
+	}
+}
+
+// likelyFeed reports whether href looks like a feed url.
+func likelyFeed(href string) bool {
+	h := strings.ToLower(href)
+	return strings.Contains(h, "rss") ||
+		strings.Contains(h, "atom") ||
+		strings.Contains(h, "feed")
+}
+
+// wellKnownFeeds are the paths probed when a page neither declares
+// nor links to a feed.
+var wellKnownFeeds = []string{"/feed", "/rss.xml", "/atom.xml", "/index.xml"}
+
+// probeFeeds tries the well-known feed paths next to page and
+// returns the first that answers with something feed-shaped.
+func probeFeeds(c *http.Client, page *url.URL) string {
+	if page == nil {
+		return ""
+	}
+	for _, p := range wellKnownFeeds {
+		u, err := page.Parse(p)
+		if err != nil {
+			continue
+		}
+		resp, err := c.Get(u.String())
+		if err != nil {
+			continue
+		}
+		ct := resp.Header.Get("Content-Type")
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			continue
+		}
+		if strings.Contains(ct, "rss") || strings.Contains(ct, "atom") ||
+			strings.Contains(ct, "xml") || strings.Contains(ct, "json") {
+			return u.String()
+		}
+	}
+	return ""
+}
+
+// loadFeed fetches and parses the configured feed and builds its
+// directories: one for most sources, one per declared feed when the
+// all-feeds option is set and the url points at a page announcing
+// several.
+func (f *RSSFs) loadFeed(fc feedConfig) ([]fs.Entry, error) {
+	if !fc.AllFeeds {
+		b, err := f.fetchFeed(fc)
+		if *wayback && feedGone(err) {
+			if d, werr := f.loadWayback(fc); werr == nil {
+				return []fs.Entry{d}, nil
+			}
+		}
+		if errors.Is(err, errNoFeed) {
+			// The page may still mark up posts as microformats,
+			// or at least have a sitemap to synthesize items from.
+			if d, herr := f.loadHFeed(fc); herr == nil {
+				return []fs.Entry{d}, nil
+			}
+			if d, serr := f.loadSitemap(fc); serr == nil {
+				return []fs.Entry{d}, nil
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		d, err := f.parseFeed(b, fc)
+		if err != nil {
+			return nil, err
+		}
+		return []fs.Entry{d}, nil
+	}
+
+	c, track := trackingClient(fc.client())
+	urls, err := feedUrls(c, fc.URL)
+	if err != nil {
+		return nil, err
+	}
+	if nu := track.final; nu != "" && nu != fc.URL {
+		f.updateFeedURL(fc.URL, nu)
+	}
+
+	var dirs []fs.Entry
+	for _, fu := range urls {
+		b, err := get(fc.client(), fu)
+		if err != nil {
+			log.Printf("%s: %v", fu, err)
+			continue
+		}
+		d, err := f.parseFeed(b, fc)
+		if err != nil {
+			log.Printf("%s: %v", fu, err)
+			continue
+		}
+		dirs = append(dirs, d)
+	}
+	if len(dirs) == 0 {
+		return nil, errNoFeed
+	}
+	return dirs, nil
+}
+
+// loadHFeed synthesizes a feed from h-entry microformat markup, so
+// indieweb sites publishing no rss/atom/json feed can be mounted
+// too. The entries are converted to an atom document and run
+// through the normal parser.
+func (f *RSSFs) loadHFeed(fc feedConfig) (fs.Entry, error) {
+	resp, err := fc.client().Get(fc.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := checkStatus(resp, fc.URL); err != nil {
+		return nil, err
+	}
+	if !strings.Contains(resp.Header.Get("Content-Type"), "html") {
+		return nil, errNoFeed
+	}
+	doc, err := html.Parse(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	page := resp.Request.URL
+
+	var entries []*html.Node
+	findNodes(doc, "h-entry", &entries)
+	if len(entries) == 0 {
+		return nil, errNoFeed
+	}
+
+	feed := atomFeed{Title: page.String()}
+	if t := findNode(doc, "", "title"); t != nil {
+		if s := strings.TrimSpace(nodeText(t)); s != "" {
+			feed.Title = s
+		}
+	}
+	for _, e := range entries {
+		var entry atomEntry
+		if n := findNode(e, "p-name", ""); n != nil {
+			entry.Title = strings.TrimSpace(nodeText(n))
+		}
+		if n := findNode(e, "u-url", ""); n != nil {
+			href := nodeAttr(n, "href")
+			if href == "" {
+				href = strings.TrimSpace(nodeText(n))
+			}
+			if u, err := page.Parse(href); err == nil {
+				href = u.String()
+			}
+			entry.Link.Href = href
+			entry.ID = href
+		}
+		if n := findNode(e, "dt-published", ""); n != nil {
+			entry.Updated = nodeAttr(n, "datetime")
+			if entry.Updated == "" {
+				entry.Updated = strings.TrimSpace(nodeText(n))
+			}
+		}
+		if entry.Title == "" {
+			entry.Title = entry.Link.Href
+		}
+		if entry.Title == "" && entry.ID == "" {
+			continue
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+	if len(feed.Entries) == 0 {
+		return nil, errNoFeed
+	}
+
+	b, err := xml.Marshal(feed)
+	if err != nil {
+		return nil, err
+	}
+	return f.parseFeed(b, fc)
+}
+
+// findNodes collects all nodes below n carrying class, depth first.
+func findNodes(n *html.Node, class string, out *[]*html.Node) {
+	if hasClass(n, class) {
+		*out = append(*out, n)
+		return
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		findNodes(c, class, out)
+	}
+}
+
+// findNode returns the first node below n carrying class, or whose
+// element name is elem when class is "".
+func findNode(n *html.Node, class, elem string) *html.Node {
+	if (class != "" && hasClass(n, class)) ||
+		(elem != "" && n.Type == html.ElementNode && n.Data == elem) {
+		return n
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if m := findNode(c, class, elem); m != nil {
+			return m
+		}
+	}
+	return nil
+}
+
+// hasClass reports whether n's class attribute contains class.
+func hasClass(n *html.Node, class string) bool {
+	if n.Type != html.ElementNode {
+		return false
+	}
+	for _, f := range strings.Fields(nodeAttr(n, "class")) {
+		if f == class {
+			return true
+		}
+	}
+	return false
+}
+
+// nodeAttr returns n's attribute key, "" if unset.
+func nodeAttr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// nodeText returns the concatenated text below n.
+func nodeText(n *html.Node) string {
+	if n.Type == html.TextNode {
+		return n.Data
+	}
+	var b strings.Builder
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		b.WriteString(nodeText(c))
+	}
+	return b.String()
+}
+
+// feedGone reports whether err says the feed no longer exists.
+func feedGone(err error) bool {
+	var se *statusError
+	if !errors.As(err, &se) {
+		return false
+	}
+	return se.code == http.StatusNotFound || se.code == http.StatusGone
+}
+
+// loadWayback serves the latest internet archive snapshot of a feed
+// that has gone away, preserving access to the historical items.
+func (f *RSSFs) loadWayback(fc feedConfig) (fs.Entry, error) {
+	b, err := get(httpClient, "https://archive.org/wayback/available?url="+url.QueryEscape(fc.URL))
+	if err != nil {
+		return nil, err
+	}
+	var res struct {
+		Snapshots struct {
+			Closest struct {
+				Available bool   `json:"available"`
+				URL       string `json:"url"`
+			} `json:"closest"`
+		} `json:"archived_snapshots"`
+	}
+	if err := json.Unmarshal(b, &res); err != nil {
+		return nil, err
+	}
+	if !res.Snapshots.Closest.Available {
+		return nil, fmt.Errorf("%s: no wayback snapshot", fc.URL)
+	}
+	log.Printf("%s: feed is dead, serving wayback snapshot %s", fc.URL, res.Snapshots.Closest.URL)
+
+	sb, err := get(httpClient, res.Snapshots.Closest.URL)
+	if err != nil {
+		return nil, err
+	}
+	return f.parseFeed(sb, fc)
+}
+
+// sitemapItems is how many of the newest sitemap urls become items
+// when a sitemap stands in for a feed.
+const sitemapItems = 10
+
+// sitemapIndex is the part of a sitemap.xml we care about.
+type sitemapIndex struct {
+	URLs []struct {
+		Loc     string `xml:"loc"`
+		Lastmod string `xml:"lastmod"`
+	} `xml:"url"`
+}
+
+// loadSitemap synthesizes a pseudo-feed from the site's sitemap.xml,
+// for sites with no feed at all: the newest urls become items with
+// title, link and published files.
+func (f *RSSFs) loadSitemap(fc feedConfig) (fs.Entry, error) {
+	base, err := url.Parse(fc.URL)
+	if err != nil {
+		return nil, err
+	}
+	su, err := base.Parse("/sitemap.xml")
+	if err != nil {
+		return nil, err
+	}
+	b, err := get(fc.client(), su.String())
+	if err != nil {
+		return nil, err
+	}
+	var sm sitemapIndex
+	if err := xml.Unmarshal(b, &sm); err != nil {
+		return nil, err
+	}
+	if len(sm.URLs) == 0 {
+		return nil, errNoFeed
+	}
+
+	// Lastmod is iso 8601, so newest-first is a string sort.
+	sort.SliceStable(sm.URLs, func(i, j int) bool {
+		return sm.URLs[i].Lastmod > sm.URLs[j].Lastmod
+	})
+	if len(sm.URLs) > sitemapItems {
+		sm.URLs = sm.URLs[:sitemapItems]
+	}
+
+	var items []fs.Entry
+	for _, su := range sm.URLs {
+		mtime := time.Now()
+		if t, err := time.Parse(time.RFC3339, su.Lastmod); err == nil {
+			mtime = t
+		} else if t, err := time.Parse("2006-01-02", su.Lastmod); err == nil {
+			mtime = t
+		}
+		title := pageTitle(fc.client(), su.Loc)
+		if title == "" {
+			title = mediaName(su.Loc)
+		}
+		var files []fs.Entry
+		add := func(name, content string) {
+			nf := newFile(name, f.uid, f.gid, mtime, []byte(content))
+			// Every synthesized item has a title file; the qid must
+			// tell them apart, as in loadItem.
+			nf.stat.Qid.Path = qidPath(su.Loc + "\x00" + name)
+			files = append(files, nf)
+		}
+		add("title", title+"\n")
+		add("link", su.Loc+"\n")
+		if su.Lastmod != "" {
+			add("published", su.Lastmod+"\n")
+		}
+		id := newDir(cleanName(title), f.uid, f.gid, files)
+		// The page url is the item's identity; titles may repeat.
+		id.stat.Qid.Path = qidPath(su.Loc)
+		items = append(items, id)
+	}
+	d := newDir(cleanName(base.Host), f.uid, f.gid, items)
+	d.stat.Qid.Path = qidPath(fc.URL + "\x00" + base.Host)
+	return d, nil
+}
+
+// titleCache remembers page titles across refreshes, so sitemap
+// items don't refetch every page each interval.
+var (
+	titleMu    sync.Mutex
+	titleCache = make(map[string]string)
+)
+
+// pageTitle fetches u and returns its html title, "" on any failure.
+func pageTitle(c *http.Client, u string) string {
+	titleMu.Lock()
+	t, ok := titleCache[u]
+	titleMu.Unlock()
+	if ok {
+		return t
+	}
+	resp, err := c.Get(u)
+	if err != nil {
+		return ""
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return ""
+	}
+	t = findTitle(resp.Body)
+	titleMu.Lock()
+	titleCache[u] = t
+	titleMu.Unlock()
+	return t
+}
+
+// findTitle returns the text of an html page's title tag.
+func findTitle(r io.Reader) string {
+	z := html.NewTokenizer(r)
+	depth := 0
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return ""
+		case html.StartTagToken:
+			if t := z.Token(); t.Data == "title" {
+				depth++
+			}
+		case html.TextToken:
+			if depth > 0 {
+				return strings.TrimSpace(z.Token().Data)
+			}
+		case html.EndTagToken:
+			if t := z.Token(); t.Data == "title" {
+				depth--
+			}
+		}
+	}
+}
+
+// xmlEncoding returns the encoding declared in an xml declaration,
+// "" if there is none.
+func xmlEncoding(b []byte) string {
+	head := b
+	if len(head) > 256 {
+		head = head[:256]
+	}
+	s := string(head)
+	if !strings.HasPrefix(s, "<?xml") {
+		return ""
+	}
+	end := strings.Index(s, "?>")
+	if end < 0 {
+		return ""
+	}
+	decl := s[:end]
+	i := strings.Index(decl, "encoding=")
+	if i < 0 {
+		return ""
+	}
+	rest := decl[i+len("encoding="):]
+	if len(rest) < 2 || (rest[0] != '"' && rest[0] != '\'') {
+		return ""
+	}
+	quote := rest[0]
+	j := strings.IndexByte(rest[1:], quote)
+	if j < 0 {
+		return ""
+	}
+	return rest[1 : 1+j]
+}
+
+// decodeCharset converts feed data declared or sniffed as a non
+// utf-8 encoding (iso-8859-1, windows-1251, ...) to utf-8, so file
+// names and contents don't come out as mojibake. Data that is
+// already utf-8 passes through unchanged.
+func decodeCharset(b []byte) []byte {
+	var r io.Reader
+	if label := xmlEncoding(b); label != "" && !strings.EqualFold(label, "utf-8") {
+		cr, err := charset.NewReaderLabel(label, bytes.NewReader(b))
+		if err != nil {
+			return b
+		}
+		r = cr
+	} else {
+		cr, err := charset.NewReader(bytes.NewReader(b), "")
+		if err != nil {
+			return b
+		}
+		r = cr
+	}
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		return b
+	}
+	// The declaration still names the old encoding; drop it so the
+	// xml parser doesn't refuse the now-utf-8 document.
+	if label := xmlEncoding(out); label != "" && !strings.EqualFold(label, "utf-8") {
+		end := bytes.Index(out, []byte("?>"))
+		decl := out[:end]
+		for _, q := range []string{`"`, "'"} {
+			old := []byte(" encoding=" + q + label + q)
+			decl = bytes.Replace(decl, old, nil, 1)
+		}
+		out = append(decl, out[end:]...)
+	}
+	return out
+}
+
+// xmlEntities are the five entities xml defines; everything else a
+// feed uses is an html-ism the parser would choke on.
+var xmlEntities = map[string]bool{
+	"amp": true, "lt": true, "gt": true, "apos": true, "quot": true,
+}
+
+// cleanXML repairs the common sins of hand-written feeds for
+// -lenient mode: stray control characters are dropped, bare
+// ampersands are escaped, and html entities xml doesn't define
+// (&nbsp; and friends) are decoded to their characters.
+func cleanXML(b []byte) []byte {
+	entityChar := func(c byte) bool {
+		return c == '#' || (c >= '0' && c <= '9') ||
+			(c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+	}
+
+	var out bytes.Buffer
+	out.Grow(len(b))
+	for i := 0; i < len(b); i++ {
+		c := b[i]
+		if c < 0x20 && c != '\t' && c != '\n' && c != '\r' {
+			continue
+		}
+		if c != '&' {
+			out.WriteByte(c)
+			continue
+		}
+		end := -1
+		for j := i + 1; j < len(b) && j < i+32; j++ {
+			if b[j] == ';' {
+				end = j
+				break
+			}
+			if !entityChar(b[j]) {
+				break
+			}
+		}
+		if end < 0 {
+			out.WriteString("&amp;")
+			continue
+		}
+		name := string(b[i+1 : end])
+		switch {
+		case xmlEntities[name], strings.HasPrefix(name, "#"):
+			out.Write(b[i : end+1])
+		default:
+			if s := html.UnescapeString(string(b[i : end+1])); s != string(b[i:end+1]) {
+				out.WriteString(s)
+			} else {
+				out.WriteString("&amp;" + name + ";")
+			}
+		}
+		i = end
+	}
+	return out.Bytes()
+}
+
+// parseFeed builds a feed directory from raw feed data.
+func (f *RSSFs) parseFeed(b []byte, fc feedConfig) (fs.Entry, error) {
+	b = decodeCharset(b)
+	if *lenient {
+		b = cleanXML(b)
+	}
+	feed, err := gofeed.NewParser().Parse(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	if f.push != nil {
+		f.push.maybeSubscribe(b, fc)
+	}
+
+	// Adopt the feed's own idea of its url (rel=self), so future
+	// fetches hit the canonical location directly. Not with
+	// all-feeds, where several feeds share one configured url.
+	if u, err := url.Parse(fc.URL); err == nil && !fc.AllFeeds &&
+		(u.Scheme == "http" || u.Scheme == "https") {
+		if _, self := findHubTopic(b); self != "" && self != fc.URL {
+			if su, err := url.Parse(self); err == nil && (su.Scheme == "http" || su.Scheme == "https") {
+				f.updateFeedURL(fc.URL, self)
+			}
+		}
+	}
+
+	var items []fs.Entry
+	for _, item := range feed.Items {
+		if f.isHidden(itemID(item)) {
+			continue
+		}
+		items = append(items, f.loadItem(item, fc))
+	}
+	d := newDir(cleanName(feed.Title), f.uid, f.gid, items)
+	// Two subscriptions may share a title; the url is what makes a
+	// feed dir itself.
+	d.stat.Qid.Path = qidPath(fc.URL + "\x00" + feed.Title)
+	return d, nil
+}
+
+// itemID is the identity an item keeps across refreshes, used to
+// remember removed items.
+func itemID(item *gofeed.Item) string {
+	if item.GUID != "" {
+		return item.GUID
+	}
+	if item.Link != "" {
+		return item.Link
+	}
+	return item.Title
+}
+
+// loadItem builds the directory for a single feed item.
+func (f *RSSFs) loadItem(item *gofeed.Item, fc feedConfig) fs.Entry {
+	mtime := time.Now()
+	if item.PublishedParsed != nil {
+		mtime = *item.PublishedParsed
+	}
+
+	id := itemID(item)
+	var files []fs.Entry
+	add := func(name, content string) {
+		if content == "" {
+			return
+		}
+		nf := newFile(name, f.uid, f.gid, mtime, []byte(content))
+		// Every item has a title file; the qid must tell them apart.
+		nf.stat.Qid.Path = qidPath(id + "\x00" + name)
+		files = append(files, nf)
+	}
+
+	add("title", item.Title+"\n")
+	if fc.ExpandLinks && shortener(item.Link) {
+		files = append(files, newCanonicalFile("link", item.Link, fc.client(), f.uid, f.gid, mtime))
+	} else {
+		add("link", item.Link+"\n")
+	}
+	published := item.Published
+	if published == "" && item.DublinCoreExt != nil && len(item.DublinCoreExt.Date) > 0 {
+		published = item.DublinCoreExt.Date[0]
+	}
+	add("published", published+"\n")
+	author := ""
+	if item.Author != nil {
+		author = item.Author.Name
+	}
+	if author == "" && item.DublinCoreExt != nil && len(item.DublinCoreExt.Creator) > 0 {
+		author = item.DublinCoreExt.Creator[0]
+	}
+	if author != "" {
+		add("author", author+"\n")
+	}
+	content := item.Content
+	if content == "" {
+		content = item.Description
+	}
+	add("content", content)
+
+	if fc.Canonical && item.Link != "" {
+		files = append(files, newCanonicalFile("canonical_link", item.Link, fc.client(), f.uid, f.gid, mtime))
+	}
+
+	// The article page itself, fetched lazily like an enclosure so
+	// mounting doesn't pull every page; the media machinery brings
+	// the disk cache and conditional revalidation along for free.
+	if fc.Article && item.Link != "" {
+		name := "article.html"
+		if fc.ArticleCmd != "" {
+			name = "article.txt"
+		}
+		af := newMediaFile(name, f.uid, f.gid, mtime, item.Link, 0)
+		if fc.ArticleCmd != "" {
+			af.filter = strings.Fields(fc.ArticleCmd)
+		}
+		af.client = fc.client()
+		files = append(files, af)
+	}
+
+	var media []*mediaFile
+	if encs := mediaEnclosures(item); len(encs) > 0 {
+		urls := make([]string, len(encs))
+		for i, e := range encs {
+			urls[i] = e.URL
+		}
+		names := mediaNames(urls)
+		if *stableNames {
+			for i := range names {
+				names[i] = stableName(item, mtime, urls[i], i, len(urls))
+			}
+		}
+		for i, e := range encs {
+			length, _ := strconv.ParseUint(e.Length, 10, 64)
+			media = append(media, newMediaFile(names[i], f.uid, f.gid, mtime, e.URL, length))
+		}
+	} else if vu := videoLink(item); vu != "" && *videoCmd != "" {
+		mf := newMediaFile(cleanName(item.Title)+".mp4", f.uid, f.gid, mtime, vu, 0)
+		mf.cmd = videoCommand(vu)
+		media = append(media, mf)
+	}
+	for _, mf := range media {
+		if fc.Filter != "" {
+			mf.filter = strings.Fields(fc.Filter)
+		}
+		if fc.ExclusiveMedia {
+			mf.setExclusive()
+		}
+		mf.client = fc.client()
+		files = append(files, mf)
+		files = append(files, newShaFile(mf, f.uid, f.gid, mtime))
+		if *stableNames {
+			add(mf.Stat().Name+".origname", mediaName(mf.url)+"\n")
+		}
+
+		attrs := mediaAttrs(item, mf.url)
+		for _, k := range mediaAttrKeys {
+			if v, ok := attrs[k]; ok {
+				add(mf.Stat().Name+"."+k, v+"\n")
+			}
+		}
+	}
+
+	if d := extDir(item.Extensions, id, f.uid, f.gid, mtime); d != nil {
+		files = append(files, d)
+	}
+
+	d := newDir(cleanName(item.Title), f.uid, f.gid, files)
+	d.itemID = id
+	// The title is display only; the guid is the item's identity, so
+	// retitled items keep their qid and same-titled items don't
+	// share one.
+	d.stat.Qid.Path = qidPath(id)
+	return d
+}
+
+// extDir builds the ext directory exposing the item's namespace
+// extensions as ext/<namespace>/<element> files, so fields like
+// dc:creator or custom publisher data aren't silently dropped. nil
+// when the item carries none. Qids are namespaced by the item's id,
+// like the rest of its files: every item has an ext dir and many
+// share element names, and identical identity strings would alias in
+// client caches.
+func extDir(extensions ext.Extensions, id, uid, gid string, mtime time.Time) fs.Entry {
+	var nsNames []string
+	for ns := range extensions {
+		nsNames = append(nsNames, ns)
+	}
+	sort.Strings(nsNames)
+
+	var nsDirs []fs.Entry
+	for _, ns := range nsNames {
+		elems := extensions[ns]
+		var elemNames []string
+		for name := range elems {
+			elemNames = append(elemNames, name)
+		}
+		sort.Strings(elemNames)
+
+		var files []fs.Entry
+		for _, name := range elemNames {
+			content := extContent(elems[name])
+			if content == "" {
+				continue
+			}
+			nf := newFile(cleanName(name), uid, gid, mtime, []byte(content))
+			nf.stat.Qid.Path = qidPath(id + "\x00ext/" + ns + "/" + name)
+			files = append(files, nf)
+		}
+		if len(files) > 0 {
+			nd := newDir(cleanName(ns), uid, gid, files)
+			nd.stat.Qid.Path = qidPath(id + "\x00ext/" + ns)
+			nsDirs = append(nsDirs, nd)
+		}
+	}
+	if len(nsDirs) == 0 {
+		return nil
+	}
+	d := newDir("ext", uid, gid, nsDirs)
+	d.stat.Qid.Path = qidPath(id + "\x00ext")
+	return d
+}
+
+// extContent renders extension elements as file content: one line
+// per element value, and key=value lines for the attributes of
+// elements that have no value of their own.
+func extContent(exts []ext.Extension) string {
+	var b strings.Builder
+	for _, e := range exts {
+		if e.Value != "" {
+			b.WriteString(e.Value + "\n")
+			continue
+		}
+		var keys []string
+		for k := range e.Attrs {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			b.WriteString(k + "=" + e.Attrs[k] + "\n")
+		}
+	}
+	return b.String()
+}
+
+// canonicalFile serves the canonical url of its item: the
+// rel=canonical link of the page behind the item link, or failing
+// that wherever redirects lead. The link is only followed on first
+// read, so mounting doesn't hit every article page.
+type canonicalFile struct {
+	stat   stat.Stat
+	url    string
+	client *http.Client
+
+	mu sync.Mutex
+	b  []byte
+	r  *bytes.Reader
+}
+
+// newCanonicalFile makes a file called name that resolves to the
+// canonical url behind u.
+func newCanonicalFile(name, u string, c *http.Client, uid, gid string, mtime time.Time) *canonicalFile {
+	return &canonicalFile{
+		stat: stat.Stat{
+			Qid: qid.Qid{
+				Type: qid.TypeFile,
+				Path: qidPath(u + "#" + name),
+			},
+			Mode:  0444,
+			Atime: mtime,
+			Mtime: mtime,
+			Name:  name,
+			Uid:   uid,
+			Gid:   gid,
+			Muid:  uid,
+		},
+		url:    u,
+		client: c,
+	}
+}
+
+func (c *canonicalFile) Stat() stat.Stat {
+	return c.stat
+}
+
+// resolveCache remembers resolved urls across refreshes, so rebuilt
+// trees don't refetch pages that have already been resolved.
+var (
+	resolveMu    sync.Mutex
+	resolveCache = make(map[string]string)
+)
+
+// ensure resolves the canonical url once. The fetch observes ctx, so
+// a flushed or disconnected read doesn't keep it going.
+func (c *canonicalFile) ensure(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.r != nil {
+		return nil
+	}
+	resolveMu.Lock()
+	cached, ok := resolveCache[c.url]
+	resolveMu.Unlock()
+	if ok {
+		c.set(cached)
+		return nil
+	}
+	req, err := http.NewRequest("GET", c.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkStatus(resp, c.url); err != nil {
+		return err
+	}
+
+	canonical := resp.Request.URL.String()
+	if strings.Contains(resp.Header.Get("Content-Type"), "html") {
+		if href := findCanonical(resp.Body); href != "" {
+			if cu, err := resp.Request.URL.Parse(href); err == nil {
+				canonical = cu.String()
+			}
+		}
+	}
+	resolveMu.Lock()
+	resolveCache[c.url] = canonical
+	resolveMu.Unlock()
+	c.set(canonical)
+	return nil
+}
+
+// set fills the file content with the resolved url; the caller holds
+// c.mu.
+func (c *canonicalFile) set(u string) {
+	c.b = []byte(u + "\n")
+	c.r = bytes.NewReader(c.b)
+	c.stat.Length = uint64(len(c.b))
+}
+
+func (c *canonicalFile) open() io.ReadSeeker {
+	return &lazyReader{ensure: c.ensure, content: func() []byte {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.b
+	}}
+}
+
+func (c *canonicalFile) Read(p []byte) (int, error) {
+	if err := c.ensure(context.Background()); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+func (c *canonicalFile) Seek(offset int64, whence int) (int64, error) {
+	if err := c.ensure(context.Background()); err != nil {
+		return 0, err
+	}
+	return c.r.Seek(offset, whence)
+}
+
+// findCanonical scans an html page for a link rel=canonical tag and
+// returns its href, "" if there is none.
+func findCanonical(r io.Reader) string {
+	z := html.NewTokenizer(r)
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return ""
+		case html.StartTagToken, html.SelfClosingTagToken:
+			t := z.Token()
+			if t.Data != "link" {
+				continue
+			}
+			var rel, href string
+			for _, a := range t.Attr {
+				switch a.Key {
+				case "rel":
+					rel = a.Val
+				case "href":
+					href = a.Val
+				}
+			}
+			if rel == "canonical" && href != "" {
+				return href
+			}
+		}
+	}
+}
+
+// shortener reports whether u lives on a known link shortener
+// domain, whose targets are worth resolving.
+func shortener(u string) bool {
+	p, err := url.Parse(u)
+	if err != nil {
+		return false
+	}
+	switch strings.TrimPrefix(p.Host, "www.") {
+	case "t.co", "bit.ly", "tinyurl.com", "goo.gl", "ow.ly", "buff.ly", "dlvr.it",
+		"feedproxy.google.com", "feeds.feedburner.com":
+		return true
+	}
+	return false
+}
+
+// mediaEnclosures returns the item's enclosures worth exposing as
+// files: audio, video, images (photo blogs, comics) and documents
+// (pdf and epub attachments on newsletters and journals). Feeds
+// carrying their media only as media:content or media:thumbnail
+// extensions get enclosures synthesized from those.
+func mediaEnclosures(item *gofeed.Item) []*gofeed.Enclosure {
+	var encs []*gofeed.Enclosure
+	for _, e := range item.Enclosures {
+		if wantEnclosure(e.Type) {
+			encs = append(encs, e)
+		}
+	}
+	if len(encs) > 0 {
+		return encs
+	}
+	for _, e := range item.Extensions["media"]["content"] {
+		u := e.Attrs["url"]
+		if u == "" {
+			continue
+		}
+		typ := e.Attrs["type"]
+		if typ == "" {
+			typ = mime.TypeByExtension(path.Ext(mediaName(u)))
+		}
+		if wantEnclosure(typ) {
+			encs = append(encs, &gofeed.Enclosure{URL: u, Type: typ, Length: e.Attrs["fileSize"]})
+		}
+	}
+	if len(encs) > 0 {
+		return encs
+	}
+	for _, e := range item.Extensions["media"]["thumbnail"] {
+		u := e.Attrs["url"]
+		if u == "" {
+			continue
+		}
+		typ := mime.TypeByExtension(path.Ext(mediaName(u)))
+		if typ == "" {
+			typ = "image/jpeg"
+		}
+		encs = append(encs, &gofeed.Enclosure{URL: u, Type: typ})
+	}
+	return encs
+}
+
+// wantEnclosure reports whether an enclosure of this media type is
+// worth exposing as a file.
+func wantEnclosure(typ string) bool {
+	switch {
+	case strings.HasPrefix(typ, "audio/"),
+		strings.HasPrefix(typ, "video/"),
+		strings.HasPrefix(typ, "image/"):
+		return true
+	case typ == "application/pdf",
+		typ == "application/epub+zip",
+		typ == "application/epub":
+		return true
+	}
+	return false
+}
+
+// mediaNames returns a file name per enclosure url. Urls sharing the
+// same basename (.../ep1/audio.mp3 and .../ep1-hq/audio.mp3) get a
+// short url-hash suffix so they don't collide within the item.
+func mediaNames(urls []string) []string {
+	names := make([]string, len(urls))
+	count := make(map[string]int)
+	for i, u := range urls {
+		names[i] = mediaName(u)
+		count[names[i]]++
+	}
+	for i, n := range names {
+		if count[n] < 2 {
+			continue
+		}
+		ext := path.Ext(n)
+		h := sha256.Sum256([]byte(urls[i]))
+		names[i] = strings.TrimSuffix(n, ext) + "-" + hex.EncodeToString(h[:4]) + ext
+	}
+	return names
+}
+
+// stableName derives a media file name from the item guid and date
+// instead of the enclosure url. Cdn urls change across refreshes,
+// renaming the file and breaking client bookmarks; the guid doesn't.
+func stableName(item *gofeed.Item, mtime time.Time, u string, i, n int) string {
+	id := item.GUID
+	if id == "" {
+		id = item.Link
+	}
+	if id == "" {
+		id = u
+	}
+	h := sha256.Sum256([]byte(id))
+	name := mtime.Format("2006-01-02") + "-" + hex.EncodeToString(h[:4])
+	if n > 1 {
+		name += "-" + strconv.Itoa(i+1)
+	}
+	return name + path.Ext(mediaName(u))
+}
+
+// mediaAttrKeys are the media:content attributes exposed as
+// metadata files next to the media file.
+var mediaAttrKeys = []string{"duration", "bitrate", "width", "height"}
+
+// mediaAttrs returns the media:content attributes the feed supplies
+// for the enclosure at url.
+func mediaAttrs(item *gofeed.Item, url string) map[string]string {
+	attrs := make(map[string]string)
+	for _, e := range item.Extensions["media"]["content"] {
+		if u := e.Attrs["url"]; u != "" && u != url {
+			continue
+		}
+		for _, k := range mediaAttrKeys {
+			if v := e.Attrs[k]; v != "" {
+				attrs[k] = v
+			}
+		}
+	}
+	return attrs
+}
+
+// videoLink returns the item's link or guid if it points at a video
+// host the external downloader can handle, "" otherwise.
+func videoLink(item *gofeed.Item) string {
+	for _, u := range []string{item.Link, item.GUID} {
+		p, err := url.Parse(u)
+		if err != nil {
+			continue
+		}
+		switch strings.TrimPrefix(p.Host, "www.") {
+		case "youtube.com", "youtu.be", "vimeo.com":
+			return u
+		}
+	}
+	return ""
+}
+
+// videoCommand expands the -video-cmd template for u, substituting
+// the url for %s.
+func videoCommand(u string) []string {
+	fields := strings.Fields(*videoCmd)
+	cmd := make([]string, len(fields))
+	for i, f := range fields {
+		cmd[i] = strings.Replace(f, "%s", u, -1)
+	}
+	return cmd
+}
+
+// mediaName derives a file name from an enclosure url.
+func mediaName(u string) string {
+	p, err := url.Parse(u)
+	if err != nil {
+		return cleanName(u)
+	}
+	return cleanName(path.Base(p.Path))
+}
+
+// cleanName makes s usable as a file name.
+func cleanName(s string) string {
+	s = strings.Replace(s, "/", "-", -1)
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return "unnamed"
+	}
+	return s
+}
@@ -0,0 +1,14 @@
+//go:build !plan9
+// +build !plan9
+
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+// postSrv posts the service to /srv, which only exists on plan 9.
+func postSrv(name string) (io.ReadWriter, error) {
+	return nil, errors.New("-srv is only supported on plan 9")
+}
@@ -0,0 +1,38 @@
+//go:build plan9
+// +build plan9
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// postSrv posts one end of a pipe to /srv/name and returns the other
+// for serving, so the filesystem can be mounted the idiomatic way:
+//
+//	mount /srv/rssfs /n/rss
+//
+// The srv device keeps its own reference to the posted end.
+func postSrv(name string) (io.ReadWriter, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile("/srv/"+name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		r.Close()
+		w.Close()
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintf(f, "%d", w.Fd()); err != nil {
+		r.Close()
+		w.Close()
+		return nil, err
+	}
+	w.Close()
+	return r, nil
+}
@@ -0,0 +1,965 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"go.rbn.im/neinp/fs"
+	"go.rbn.im/neinp/qid"
+	"go.rbn.im/neinp/stat"
+)
+
+// qids remembers which identity each issued qid path was derived
+// from, so two different identities hashing alike are caught instead
+// of silently aliasing in client caches.
+var (
+	qidMu sync.Mutex
+	qids  = make(map[uint64]string)
+)
+
+// qidPath derives a qid path by hashing id. On a collision with a
+// different identity the hash is extended deterministically until a
+// free slot turns up; the registry keeps the result stable for the
+// lifetime of the process.
+func qidPath(id string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	p := h.Sum64()
+	qidMu.Lock()
+	defer qidMu.Unlock()
+	for {
+		owner, ok := qids[p]
+		if !ok {
+			qids[p] = id
+			return p
+		}
+		if owner == id {
+			return p
+		}
+		h.Write([]byte{0})
+		p = h.Sum64()
+	}
+}
+
+// opener is implemented by entries that hand out an independent
+// reader per open fid, so concurrent opens don't share a cursor.
+type opener interface {
+	open() io.ReadSeeker
+}
+
+// ctxReader is implemented by readers whose blocking work (waiting
+// for download bytes, http fetches) should observe the request
+// context, so Tflush and client disconnects abort it promptly.
+type ctxReader interface {
+	readCtx(ctx context.Context, p []byte) (int, error)
+}
+
+// writable is implemented by entries that accept Twrite. Whether a
+// particular client may write is still decided by the entry's mode
+// bits.
+type writable interface {
+	writeAt(p []byte, off int64) (int, error)
+}
+
+// handle is a fid's open state: the shared tree entry for stats,
+// plus this fid's own reader over the immutable content.
+type handle struct {
+	fs.Entry
+	r io.ReadSeeker
+}
+
+func (h *handle) Read(p []byte) (int, error) {
+	return h.r.Read(p)
+}
+
+func (h *handle) readCtx(ctx context.Context, p []byte) (int, error) {
+	if cr, ok := h.r.(ctxReader); ok {
+		return cr.readCtx(ctx, p)
+	}
+	return h.r.Read(p)
+}
+
+func (h *handle) Seek(offset int64, whence int) (int64, error) {
+	return h.r.Seek(offset, whence)
+}
+
+// dir is a read-only directory. Reading it yields the marshalled
+// stats of its children, as 9p wants it.
+type dir struct {
+	stat     stat.Stat
+	children []fs.Entry
+	content  []byte
+	*bytes.Reader
+
+	// what removing this directory means: feed dirs carry the
+	// subscription url, item dirs the item identity. Both empty for
+	// everything else, which can't be removed.
+	feedURL string
+	itemID  string
+
+	// parent directory, for walking "..". nil for the root, where
+	// ".." stays put.
+	parent *dir
+}
+
+// newDir assembles a directory from its children. The serialized
+// directory contents are built once, here; the tree is immutable
+// after construction.
+func newDir(name, uid, gid string, children []fs.Entry) *dir {
+	var buf bytes.Buffer
+	for _, c := range children {
+		b, _ := c.Stat().MarshalBinary()
+		buf.Write(b)
+	}
+
+	now := time.Now()
+	d := &dir{
+		stat: stat.Stat{
+			Qid: qid.Qid{
+				Type: qid.TypeDir,
+				Path: qidPath(name),
+			},
+			Mode:   stat.Dir | 0555,
+			Atime:  now,
+			Mtime:  now,
+			Name:   name,
+			Uid:    uid,
+			Gid:    gid,
+			Muid:   uid,
+			Length: 0,
+		},
+		children: children,
+		content:  buf.Bytes(),
+		Reader:   bytes.NewReader(buf.Bytes()),
+	}
+	for _, c := range children {
+		if cd, ok := c.(*dir); ok {
+			cd.parent = d
+		}
+	}
+	return d
+}
+
+func (d *dir) open() io.ReadSeeker {
+	return &dirReader{d: d}
+}
+
+// dirReader is one fid's cursor over a directory. 9p wants directory
+// reads to restart at offset 0 or continue exactly where the last
+// read stopped, with each reply holding a whole number of stat
+// records; the reader tracks both and marshals entries as they are
+// asked for.
+type dirReader struct {
+	d    *dir
+	next int   // index of the next child to marshal
+	off  int64 // byte offset the next read must ask for
+}
+
+// readDir returns the next batch of marshalled stats fitting count
+// bytes, owned by uname when the session has one.
+func (r *dirReader) readDir(offset uint64, count uint32, uname string) ([]byte, error) {
+	if offset == 0 {
+		r.next, r.off = 0, 0
+	} else if int64(offset) != r.off {
+		return nil, errBadOffset
+	}
+	var buf []byte
+	for ; r.next < len(r.d.children); r.next++ {
+		b, err := ownedStat(r.d.children[r.next].Stat(), uname).MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		if len(buf)+len(b) > int(count) {
+			if len(buf) == 0 {
+				return nil, errSmallCount
+			}
+			break
+		}
+		buf = append(buf, b...)
+	}
+	r.off += int64(len(buf))
+	return buf, nil
+}
+
+// Read and Seek satisfy io.ReadSeeker; the 9p read path goes through
+// readDir, which owns the offset rules.
+func (r *dirReader) Read(p []byte) (int, error) {
+	b, err := r.readDir(uint64(r.off), uint32(len(p)), "")
+	if err != nil {
+		return 0, err
+	}
+	if len(b) == 0 {
+		return 0, io.EOF
+	}
+	return copy(p, b), nil
+}
+
+func (r *dirReader) Seek(offset int64, whence int) (int64, error) {
+	if offset == 0 && whence == io.SeekStart {
+		r.next, r.off = 0, 0
+		return 0, nil
+	}
+	if whence == io.SeekStart && offset == r.off {
+		return r.off, nil
+	}
+	return 0, errBadOffset
+}
+
+// lookupPath resolves a slash-separated path against root. The non-9p
+// frontends use it where a 9p client would walk.
+func lookupPath(root *dir, p string) (fs.Entry, error) {
+	e := fs.Entry(root)
+	for _, name := range strings.Split(strings.Trim(path.Clean("/"+p), "/"), "/") {
+		if name == "" {
+			continue
+		}
+		d, ok := e.(*dir)
+		if !ok {
+			return nil, errNotDir
+		}
+		c := d.child(name)
+		if c == nil {
+			return nil, errNotFound
+		}
+		e = c
+	}
+	return e, nil
+}
+
+// entryReader hands out the caller's own cursor over e, like Topen
+// does for a fid.
+func entryReader(e fs.Entry) io.ReadSeeker {
+	if o, ok := e.(opener); ok {
+		return o.open()
+	}
+	return e
+}
+
+// child returns the entry called name, or nil.
+func (d *dir) child(name string) fs.Entry {
+	for _, c := range d.children {
+		if c.Stat().Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func (d *dir) Stat() stat.Stat {
+	return d.stat
+}
+
+// file is a read-only file with static content.
+type file struct {
+	stat    stat.Stat
+	content []byte
+	*bytes.Reader
+}
+
+// newFile makes a file containing content, with mtime set to the
+// item's timestamp.
+func newFile(name, uid, gid string, mtime time.Time, content []byte) *file {
+	return &file{
+		content: content,
+		stat: stat.Stat{
+			Qid: qid.Qid{
+				Type: qid.TypeFile,
+				Path: qidPath(name),
+			},
+			Mode:   0444,
+			Atime:  mtime,
+			Mtime:  mtime,
+			Name:   name,
+			Uid:    uid,
+			Gid:    gid,
+			Muid:   uid,
+			Length: uint64(len(content)),
+		},
+		Reader: bytes.NewReader(content),
+	}
+}
+
+func (f *file) open() io.ReadSeeker {
+	return bytes.NewReader(f.content)
+}
+
+func (f *file) Stat() stat.Stat {
+	return f.stat
+}
+
+// mediaFile is an enclosure. The content is not fetched until the
+// file is actually read, so mounting a podcast feed doesn't pull
+// every episode. While the download runs, reads are served from the
+// part that has already arrived and only block when they ask for
+// bytes beyond it.
+type mediaFile struct {
+	stat   stat.Stat
+	url    string
+	cmd    []string     // if set, run this instead of fetching url over http
+	filter []string     // if set, pipe the download through this command
+	client *http.Client // nil: the shared httpClient
+
+	// exclusive-use: at most one open at a time, enforced through
+	// acquire/release.
+	exclusive bool
+
+	// readers counts the fids interested in the download, across
+	// sessions; a running transfer is aborted when the last one goes
+	// away.
+	readers int
+
+	mu      sync.Mutex
+	cond    *sync.Cond // signals buf growth and completion
+	buf     []byte
+	pos     int64 // read offset, set by Seek
+	opens   int
+	running bool
+	done    bool
+	err     error
+	cancel  context.CancelFunc
+
+	// validators from the last download, stored with the disk
+	// cache for later revalidation.
+	etag         string
+	lastModified string
+}
+
+// newMediaFile makes a lazily fetched file for the enclosure at url.
+// length is what the feed claims the enclosure size is; 0 if it
+// doesn't say.
+func newMediaFile(name, uid, gid string, mtime time.Time, url string, length uint64) *mediaFile {
+	m := &mediaFile{
+		stat: stat.Stat{
+			Qid: qid.Qid{
+				Type: qid.TypeFile,
+				Path: qidPath(url),
+			},
+			Mode:   0444,
+			Atime:  mtime,
+			Mtime:  mtime,
+			Name:   name,
+			Uid:    uid,
+			Gid:    gid,
+			Muid:   uid,
+			Length: length,
+		},
+		url: url,
+	}
+	m.cond = sync.NewCond(&m.mu)
+	return m
+}
+
+// Stat takes the mutex because run updates the length when a
+// download finishes, concurrently with Tstats and directory reads.
+func (m *mediaFile) Stat() stat.Stat {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.stat
+}
+
+// setExclusive marks m exclusive-use, reflected in its qid and mode
+// so clients see the OEXCL semantics coming.
+func (m *mediaFile) setExclusive() {
+	m.exclusive = true
+	m.stat.Qid.Type |= qid.TypeExcl
+	m.stat.Mode |= stat.Excl
+}
+
+// acquire claims the exclusive-use slot; a no-op for ordinary files.
+func (m *mediaFile) acquire() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.exclusive {
+		return nil
+	}
+	if m.opens > 0 {
+		return errInUse
+	}
+	m.opens++
+	return nil
+}
+
+// release returns the slot taken by acquire.
+func (m *mediaFile) release() {
+	m.mu.Lock()
+	if m.exclusive && m.opens > 0 {
+		m.opens--
+	}
+	m.mu.Unlock()
+}
+
+// mediaSem limits how many enclosure downloads run at once, so a
+// recursive copy of a feed doesn't open dozens of connections
+// against the same host. Sized by -media-workers in main.
+var mediaSem chan struct{}
+
+// ready reports whether the whole enclosure is in memory.
+func (m *mediaFile) ready() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.done
+}
+
+// start launches the download unless it is already running or has
+// finished. A download that failed earlier is retried.
+func (m *mediaFile) start() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.running || m.done {
+		return
+	}
+	m.err = nil
+	m.buf = nil
+	m.running = true
+
+	ctx, cancel := context.WithCancel(context.Background())
+	m.cancel = cancel
+	go m.run(ctx)
+}
+
+// addReader notes a fid interested in the download.
+func (m *mediaFile) addReader() {
+	m.mu.Lock()
+	m.readers++
+	m.mu.Unlock()
+}
+
+// dropReader withdraws a fid's interest. When the last one goes away
+// a still-running download is cancelled, so nobody keeps pulling
+// bytes no client will read; a later read starts it afresh.
+func (m *mediaFile) dropReader() {
+	m.mu.Lock()
+	if m.readers > 0 {
+		m.readers--
+	}
+	if m.readers == 0 && m.running && m.cancel != nil {
+		m.cancel()
+	}
+	m.mu.Unlock()
+}
+
+func (m *mediaFile) run(ctx context.Context) {
+	var err error
+	if m.filter != nil {
+		err = m.runFilter(ctx)
+	} else {
+		err = m.runCached(ctx)
+	}
+	m.mu.Lock()
+	m.running = false
+	if err != nil {
+		m.err = err
+		m.buf = nil
+	} else {
+		m.done = true
+		m.stat.Length = uint64(len(m.buf))
+	}
+	m.cond.Broadcast()
+	m.mu.Unlock()
+}
+
+// appendWriter streams download output into the mediaFile's buffer,
+// waking up readers as data arrives.
+type appendWriter struct {
+	m *mediaFile
+}
+
+func (w appendWriter) Write(p []byte) (int, error) {
+	w.m.mu.Lock()
+	w.m.buf = append(w.m.buf, p...)
+	w.m.cond.Broadcast()
+	w.m.mu.Unlock()
+	return len(p), nil
+}
+
+// httpc returns the client downloads use.
+func (m *mediaFile) httpc() *http.Client {
+	if m.client != nil {
+		return m.client
+	}
+	return httpClient
+}
+
+// download pulls the enclosure, writing to w as chunks arrive.
+func (m *mediaFile) download(ctx context.Context, w io.Writer) error {
+	select {
+	case mediaSem <- struct{}{}:
+		defer func() { <-mediaSem }()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if m.cmd != nil {
+		return m.downloadCmd(ctx, w)
+	}
+
+	req, err := http.NewRequest("GET", m.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := m.httpc().Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", m.url, resp.Status)
+	}
+	m.etag = resp.Header.Get("Etag")
+	m.lastModified = resp.Header.Get("Last-Modified")
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// downloadCmd runs the configured external command and uses its
+// stdout as the media content, for links an http get can't turn into
+// a media file (youtube, vimeo, ...).
+func (m *mediaFile) downloadCmd(ctx context.Context, w io.Writer) error {
+	cmd := exec.CommandContext(ctx, m.cmd[0], m.cmd[1:]...)
+	cmd.Stdout = w
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %v", m.cmd[0], err)
+	}
+	return nil
+}
+
+// runCached serves the enclosure from the disk cache when possible
+// and otherwise downloads it, writing a copy into the cache so a
+// restarted server doesn't refetch everything.
+func (m *mediaFile) runCached(ctx context.Context) error {
+	dir, err := cacheDir()
+	if err != nil {
+		return m.download(ctx, appendWriter{m})
+	}
+	path := filepath.Join(dir, cacheName(m.url, nil))
+
+	if b, err := ioutil.ReadFile(path); err == nil && m.cacheValid(ctx, path) {
+		appendWriter{m}.Write(b)
+		return nil
+	}
+
+	tmp, err := os.Create(path + ".part")
+	if err != nil {
+		return m.download(ctx, appendWriter{m})
+	}
+	err = m.download(ctx, io.MultiWriter(appendWriter{m}, tmp))
+	tmp.Close()
+	if err != nil {
+		os.Remove(path + ".part")
+		return err
+	}
+	if err := os.Rename(path+".part", path); err != nil {
+		log.Print(err)
+		return nil
+	}
+	if err := writeCacheMeta(path, cacheMeta{
+		ETag:         m.etag,
+		LastModified: m.lastModified,
+		Fetched:      time.Now(),
+	}); err != nil {
+		log.Print(err)
+	}
+	m.mu.Lock()
+	size := int64(len(m.buf))
+	m.mu.Unlock()
+	recordCached(dir, filepath.Base(path), m.url, size)
+	return nil
+}
+
+// runFilter pipes the download through the feed's filter command and
+// exposes the filtered output, caching the result on disk so the
+// filter runs once per enclosure.
+func (m *mediaFile) runFilter(ctx context.Context) error {
+	var path string
+	if dir, err := cacheDir(); err == nil {
+		path = filepath.Join(dir, cacheName(m.url, m.filter))
+		if b, err := ioutil.ReadFile(path); err == nil && m.cacheValid(ctx, path) {
+			appendWriter{m}.Write(b)
+			return nil
+		}
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(m.download(ctx, pw))
+	}()
+
+	cmd := exec.CommandContext(ctx, m.filter[0], m.filter[1:]...)
+	cmd.Stdin = pr
+	cmd.Stdout = appendWriter{m}
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %v", m.filter[0], err)
+	}
+
+	if path != "" {
+		m.mu.Lock()
+		b := m.buf
+		m.mu.Unlock()
+		if err := ioutil.WriteFile(path, b, 0600); err != nil {
+			log.Print(err)
+		} else {
+			if err := writeCacheMeta(path, cacheMeta{
+				ETag:         m.etag,
+				LastModified: m.lastModified,
+				Fetched:      time.Now(),
+			}); err != nil {
+				log.Print(err)
+			}
+			recordCached(filepath.Dir(path), filepath.Base(path), m.url, int64(len(b)))
+		}
+	}
+	return nil
+}
+
+// cacheValid reports whether the cached copy at path can still be
+// used. Within cacheTTL of the fetch it is trusted as-is; after
+// that the origin is asked with a conditional get, so replaced
+// enclosures (common for podcasts) are picked up without a manual
+// purge. If the origin is unreachable the cache keeps serving.
+func (m *mediaFile) cacheValid(ctx context.Context, path string) bool {
+	meta, err := readCacheMeta(path)
+	if err != nil {
+		return false
+	}
+	if time.Since(meta.Fetched) < cacheTTL {
+		return true
+	}
+	// Command-fetched media has no validators and rerunning the
+	// downloader is expensive; trust it once it's on disk.
+	if m.cmd != nil {
+		return true
+	}
+	if meta.ETag == "" && meta.LastModified == "" {
+		return false
+	}
+
+	req, err := http.NewRequest("GET", m.url, nil)
+	if err != nil {
+		return false
+	}
+	if meta.ETag != "" {
+		req.Header.Set("If-None-Match", meta.ETag)
+	}
+	if meta.LastModified != "" {
+		req.Header.Set("If-Modified-Since", meta.LastModified)
+	}
+	resp, err := m.httpc().Do(req.WithContext(ctx))
+	if err != nil {
+		return true
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNotModified {
+		return false
+	}
+	meta.Fetched = time.Now()
+	if err := writeCacheMeta(path, meta); err != nil {
+		log.Print(err)
+	}
+	return true
+}
+
+// wakeOnCancel broadcasts on the cond when ctx is cancelled, so a
+// wait loop holding m.mu can notice. The broadcast takes the mutex,
+// so a wakeup can't slip between an Err check and the Wait. The
+// returned func stops the watcher.
+func (m *mediaFile) wakeOnCancel(ctx context.Context) func() {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			m.mu.Lock()
+			m.cond.Broadcast()
+			m.mu.Unlock()
+		case <-stop:
+		}
+	}()
+	return func() { close(stop) }
+}
+
+// complete starts the download if needed, waits for it to finish
+// and returns the full content. Cancelling ctx abandons the wait.
+func (m *mediaFile) complete(ctx context.Context) ([]byte, error) {
+	m.start()
+	defer m.wakeOnCancel(ctx)()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for !m.done {
+		if m.err != nil {
+			return nil, m.err
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if !m.running {
+			m.mu.Unlock()
+			m.start()
+			m.mu.Lock()
+			continue
+		}
+		m.cond.Wait()
+	}
+	return m.buf, nil
+}
+
+// readAt hands out bytes at off that have already arrived, blocking
+// only when off is beyond what has been fetched so far. Cancelling
+// ctx abandons the wait; the download itself keeps running for other
+// readers.
+func (m *mediaFile) readAt(ctx context.Context, p []byte, off int64) (int, error) {
+	m.start()
+	defer m.wakeOnCancel(ctx)()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for {
+		if int64(len(m.buf)) > off {
+			return copy(p, m.buf[off:]), nil
+		}
+		if m.err != nil {
+			return 0, m.err
+		}
+		if m.done {
+			return 0, io.EOF
+		}
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		m.cond.Wait()
+	}
+}
+
+// Read hands out bytes that have already arrived, blocking only when
+// the offset is beyond what has been fetched so far.
+func (m *mediaFile) Read(p []byte) (int, error) {
+	n, err := m.readAt(context.Background(), p, m.pos)
+	m.mu.Lock()
+	m.pos += int64(n)
+	m.mu.Unlock()
+	return n, err
+}
+
+func (m *mediaFile) open() io.ReadSeeker {
+	return &mediaReader{m: m}
+}
+
+// mediaReader is one fid's cursor over a mediaFile; the download
+// state stays shared, the offset doesn't.
+type mediaReader struct {
+	m   *mediaFile
+	pos int64
+}
+
+func (r *mediaReader) Read(p []byte) (int, error) {
+	return r.readCtx(context.Background(), p)
+}
+
+func (r *mediaReader) readCtx(ctx context.Context, p []byte) (int, error) {
+	n, err := r.m.readAt(ctx, p, r.pos)
+	r.pos += int64(n)
+	return n, err
+}
+
+func (r *mediaReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+		r.pos = offset
+	case io.SeekCurrent:
+		r.pos += offset
+	case io.SeekEnd:
+		b, err := r.m.complete(context.Background())
+		if err != nil {
+			return 0, err
+		}
+		r.pos = int64(len(b)) + offset
+	default:
+		return 0, errors.New("bad whence")
+	}
+	if r.pos < 0 {
+		return 0, errors.New("negative position")
+	}
+	return r.pos, nil
+}
+
+// shaFile serves the sha256 of its media file in sha256sum format.
+// Reading it waits for (and if necessary starts) the download, since
+// the sum only exists once all bytes are here.
+type shaFile struct {
+	stat stat.Stat
+	m    *mediaFile
+
+	mu sync.Mutex
+	b  []byte
+	r  *bytes.Reader
+}
+
+// newShaFile makes the .sha256 sidecar for m.
+func newShaFile(m *mediaFile, uid, gid string, mtime time.Time) *shaFile {
+	name := m.Stat().Name + ".sha256"
+	return &shaFile{
+		stat: stat.Stat{
+			Qid: qid.Qid{
+				Type: qid.TypeFile,
+				Path: qidPath(m.url + ".sha256"),
+			},
+			Mode:   0444,
+			Atime:  mtime,
+			Mtime:  mtime,
+			Name:   name,
+			Uid:    uid,
+			Gid:    gid,
+			Muid:   uid,
+			Length: uint64(64 + 2 + len(m.Stat().Name) + 1),
+		},
+		m: m,
+	}
+}
+
+func (s *shaFile) Stat() stat.Stat {
+	return s.stat
+}
+
+// ensure computes the sum once the media is fully here.
+func (s *shaFile) ensure(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.r != nil {
+		return nil
+	}
+	b, err := s.m.complete(ctx)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(b)
+	s.b = []byte(hex.EncodeToString(sum[:]) + "  " + s.m.Stat().Name + "\n")
+	s.r = bytes.NewReader(s.b)
+	return nil
+}
+
+func (s *shaFile) open() io.ReadSeeker {
+	return &lazyReader{ensure: s.ensure, content: func() []byte { return s.b }}
+}
+
+// lazyReader is one fid's cursor over content that only exists after
+// an ensure step has run.
+type lazyReader struct {
+	ensure  func(ctx context.Context) error
+	content func() []byte
+	r       *bytes.Reader
+	pos     int64 // seek position noted before the content exists
+}
+
+func (l *lazyReader) init(ctx context.Context) error {
+	if l.r != nil {
+		return nil
+	}
+	if err := l.ensure(ctx); err != nil {
+		return err
+	}
+	l.r = bytes.NewReader(l.content())
+	if _, err := l.r.Seek(l.pos, io.SeekStart); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (l *lazyReader) Read(p []byte) (int, error) {
+	return l.readCtx(context.Background(), p)
+}
+
+func (l *lazyReader) readCtx(ctx context.Context, p []byte) (int, error) {
+	if err := l.init(ctx); err != nil {
+		return 0, err
+	}
+	return l.r.Read(p)
+}
+
+// Seek before the content exists only notes the position, so the
+// blocking ensure step runs in readCtx under the request context,
+// where Tflush can reach it, instead of under Seek's Background.
+func (l *lazyReader) Seek(offset int64, whence int) (int64, error) {
+	if l.r != nil {
+		return l.r.Seek(offset, whence)
+	}
+	switch whence {
+	case io.SeekStart:
+		l.pos = offset
+	case io.SeekCurrent:
+		l.pos += offset
+	case io.SeekEnd:
+		// Needs the size, which only ensure can provide; not on the
+		// 9p read path, which seeks from the start.
+		if err := l.init(context.Background()); err != nil {
+			return 0, err
+		}
+		return l.r.Seek(offset, whence)
+	default:
+		return 0, errors.New("bad whence")
+	}
+	if l.pos < 0 {
+		return 0, errors.New("negative position")
+	}
+	return l.pos, nil
+}
+
+func (s *shaFile) Read(p []byte) (int, error) {
+	if err := s.ensure(context.Background()); err != nil {
+		return 0, err
+	}
+	return s.r.Read(p)
+}
+
+func (s *shaFile) Seek(offset int64, whence int) (int64, error) {
+	if err := s.ensure(context.Background()); err != nil {
+		return 0, err
+	}
+	return s.r.Seek(offset, whence)
+}
+
+func (m *mediaFile) Seek(offset int64, whence int) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch whence {
+	case io.SeekStart:
+		m.pos = offset
+	case io.SeekCurrent:
+		m.pos += offset
+	case io.SeekEnd:
+		for !m.done && m.err == nil {
+			if !m.running {
+				m.mu.Unlock()
+				m.start()
+				m.mu.Lock()
+				continue
+			}
+			m.cond.Wait()
+		}
+		if m.err != nil {
+			return 0, m.err
+		}
+		m.pos = int64(len(m.buf)) + offset
+	default:
+		return 0, errors.New("bad whence")
+	}
+	if m.pos < 0 {
+		return 0, errors.New("negative position")
+	}
+	return m.pos, nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"go.rbn.im/neinp/fs"
+	"go.rbn.im/neinp/stat"
+	"golang.org/x/net/webdav"
+)
+
+// entryInfo adapts a tree entry's stat to os.FileInfo for the
+// frontends that speak in those terms.
+type entryInfo struct {
+	st stat.Stat
+}
+
+func (i entryInfo) Name() string { return i.st.Name }
+
+func (i entryInfo) Size() int64 { return int64(i.st.Length) }
+
+func (i entryInfo) Mode() os.FileMode {
+	m := os.FileMode(i.st.Mode & 0777)
+	if i.st.Mode&stat.Dir != 0 {
+		m |= os.ModeDir
+	}
+	return m
+}
+
+func (i entryInfo) ModTime() time.Time { return i.st.Mtime }
+
+func (i entryInfo) IsDir() bool { return i.st.Mode&stat.Dir != 0 }
+
+func (i entryInfo) Sys() interface{} { return nil }
+
+// serveWebdav exposes f's tree over webdav at addr, for file
+// managers and systems that speak neither 9p nor fuse. Read-only,
+// like the other non-9p frontends.
+func serveWebdav(f *RSSFs, addr string) {
+	h := &webdav.Handler{
+		FileSystem: davFS{f: f},
+		LockSystem: webdav.NewMemLS(),
+	}
+	log.Fatal(http.ListenAndServe(addr, h))
+}
+
+// davFS resolves webdav paths against the current tree root, the way
+// a 9p walk would.
+type davFS struct {
+	f *RSSFs
+}
+
+func (d davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return os.ErrPermission
+}
+
+func (d davFS) RemoveAll(ctx context.Context, name string) error {
+	return os.ErrPermission
+}
+
+func (d davFS) Rename(ctx context.Context, oldName, newName string) error {
+	return os.ErrPermission
+}
+
+func (d davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	e, err := lookupPath(d.f.rootDir(), name)
+	if err != nil {
+		return nil, os.ErrNotExist
+	}
+	return entryInfo{st: e.Stat()}, nil
+}
+
+func (d davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return nil, os.ErrPermission
+	}
+	e, err := lookupPath(d.f.rootDir(), name)
+	if err != nil {
+		return nil, os.ErrNotExist
+	}
+	return &davFile{e: e, r: entryReader(e)}, nil
+}
+
+// davFile is one open's cursor over a tree entry.
+type davFile struct {
+	e   fs.Entry
+	r   io.ReadSeeker
+	pos int // readdir position
+}
+
+func (f *davFile) Close() error { return nil }
+
+func (f *davFile) Read(p []byte) (int, error) { return f.r.Read(p) }
+
+func (f *davFile) Seek(offset int64, whence int) (int64, error) {
+	return f.r.Seek(offset, whence)
+}
+
+func (f *davFile) Write(p []byte) (int, error) { return 0, os.ErrPermission }
+
+func (f *davFile) Stat() (os.FileInfo, error) {
+	return entryInfo{st: f.e.Stat()}, nil
+}
+
+func (f *davFile) Readdir(count int) ([]os.FileInfo, error) {
+	d, ok := f.e.(*dir)
+	if !ok {
+		return nil, os.ErrInvalid
+	}
+	var infos []os.FileInfo
+	for ; f.pos < len(d.children); f.pos++ {
+		if count > 0 && len(infos) == count {
+			return infos, nil
+		}
+		infos = append(infos, entryInfo{st: d.children[f.pos].Stat()})
+	}
+	if count > 0 && len(infos) == 0 {
+		return nil, io.EOF
+	}
+	return infos, nil
+}